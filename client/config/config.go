@@ -4,5 +4,9 @@ type ClientConfig struct {
 	ScreenWidth  int
 	ScreenHeight int
 
-	ServerWebsocketURL string
+	// Where the server listens, either ws://, wss:// or tcp://.
+	ServerURL string
+
+	// Codec the client would rather write its messages with.
+	Codec string
 }
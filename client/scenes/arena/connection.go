@@ -0,0 +1,124 @@
+package arena
+
+import (
+	"astro-blasters/rpc"
+	"astro-blasters/server/messages"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	maxReconnectAttempts = 5
+	reconnectDelay       = time.Second
+)
+
+// Dials the server and joins the room, resuming the previous session if we
+// had one.
+func (self *ArenaScene) connect() (rpc.Transport, messages.ConnectionHandshakeResponse, error) {
+	var response messages.ConnectionHandshakeResponse
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	connection, err := rpc.Dial(ctx, self.config.ServerURL)
+
+	if err != nil {
+		return nil, response, fmt.Errorf("Failed to connect to the server at %s", self.config.ServerURL)
+	}
+
+	connectionHandshake := rpc.NewBaseMessage(messages.ConnectionHandshake{
+		ProtocolVersion: messages.ProtocolVersion,
+		Capabilities:    messages.SupportedCapabilities,
+		Codecs:          rpc.CodecNames(self.config.Codec),
+		PlayerName:      self.playerName,
+		RoomCode:        self.roomCode,
+		SessionToken:    self.sessionToken,
+	})
+	if err := rpc.WriteMessage(ctx, connection, connectionHandshake); err != nil {
+		connection.Close()
+		return nil, response, fmt.Errorf("Failed to send handshake to the server at %s", self.config.ServerURL)
+	}
+
+	var message rpc.BaseMessage
+	if err := rpc.ReceiveMessage(ctx, connection, &message); err != nil {
+		connection.Close()
+		return nil, response, fmt.Errorf("Error receiving handshake response: " + err.Error())
+	}
+
+	router := rpc.NewRouter()
+	rpc.Handle(router, func(rejection messages.HandshakeRejected) error {
+		return rejection
+	})
+	rpc.Handle(router, func(handshakeResponse messages.ConnectionHandshakeResponse) error {
+		response = handshakeResponse
+		return nil
+	})
+
+	if err := router.Dispatch(message); err != nil {
+		connection.Close()
+
+		var rejection messages.HandshakeRejected
+		if errors.As(err, &rejection) {
+			return nil, response, rejection
+		}
+		return nil, response, fmt.Errorf("Error receiving handshake response: " + err.Error())
+	}
+
+	// Servers that do not know about codecs keep speaking msgpack.
+	codec, err := rpc.CodecByName(response.Codec)
+	if err != nil {
+		codec = rpc.MsgpackCodec
+	}
+	connection.SetCodec(codec)
+
+	return connection, response, nil
+}
+
+// Tries to get back into the room after the connection dropped.
+func (self *ArenaScene) reconnect() error {
+	var err error
+	for attempt := 0; attempt < maxReconnectAttempts; attempt++ {
+		time.Sleep(reconnectDelay)
+
+		var connection rpc.Transport
+		var response messages.ConnectionHandshakeResponse
+		connection, response, err = self.connect()
+		if err != nil {
+			continue
+		}
+
+		self.mutex.Lock()
+		self.connection = connection
+		self.applyHandshakeResponse(response)
+		self.mutex.Unlock()
+		return nil
+	}
+
+	return fmt.Errorf("Lost the connection to the server: %w", err)
+}
+
+func (self *ArenaScene) applyHandshakeResponse(response messages.ConnectionHandshakeResponse) {
+	// The session expired, so we came back as a brand-new player.
+	if self.player != nil && response.PlayerId != self.playerId {
+		self.predictor = predictor{}
+		delete(self.interpolation, response.PlayerId)
+	}
+
+	self.playerId = response.PlayerId
+	self.roomCode = response.RoomCode
+	self.sessionToken = response.SessionToken
+
+	for _, player := range response.PlayerData {
+		entry := self.simulation.FindCorrespondingPlayer(player.PlayerId)
+		if entry == nil {
+			entry = self.simulation.CreatePlayer(player.PlayerId, &player.Position, player.PlayerName, player.IsConnected)
+		}
+
+		if player.PlayerId == response.PlayerId {
+			// Focus the camera on the player.
+			self.player = entry
+			self.camera.FocusTarget(player.Position)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package arena
+
+import (
+	"astro-blasters/game"
+	"astro-blasters/game/component"
+	"math"
+	"time"
+)
+
+const (
+	// How far in the past the remote ships are rendered. This leaves enough
+	// time for the next snapshot to arrive so that there are always two
+	// states to blend between.
+	interpolationDelayTicks = 6
+
+	// How far past the last state received from the server the remote ships
+	// are extrapolated before they are held in place.
+	maxExtrapolationTicks = 15
+
+	// Two consecutive states further apart than this are treated as a
+	// teleport, e.g. a respawn, instead of being blended.
+	teleportDistance = 200
+
+	maxBufferedStates = 32
+)
+
+type timestampedState struct {
+	Tick     uint64
+	Position component.PositionData
+}
+
+// Buffers the states of a remote entity so it can be rendered slightly in
+// the past, in between two states received from the server.
+type interpolationBuffer struct {
+	states []timestampedState
+}
+
+func (self *interpolationBuffer) Push(tick uint64, position component.PositionData) {
+	if len(self.states) > 0 {
+		last := self.states[len(self.states)-1]
+		if tick <= last.Tick {
+			return
+		}
+		if !last.Position.IntersectsWith(&position, teleportDistance) {
+			self.states = self.states[:0]
+		}
+	}
+
+	self.states = append(self.states, timestampedState{Tick: tick, Position: position})
+	if len(self.states) > maxBufferedStates {
+		self.states = self.states[1:]
+	}
+}
+
+// Returns the blended state at the given tick.
+func (self *interpolationBuffer) Sample(tick float64) (component.PositionData, bool) {
+	if len(self.states) == 0 {
+		return component.PositionData{}, false
+	}
+
+	// Drop the states that are no longer needed to blend.
+	for len(self.states) > 2 && float64(self.states[1].Tick) <= tick {
+		self.states = self.states[1:]
+	}
+
+	first := self.states[0]
+	if tick <= float64(first.Tick) || len(self.states) == 1 {
+		return first.Position, true
+	}
+
+	for i := 0; i+1 < len(self.states); i++ {
+		from, to := self.states[i], self.states[i+1]
+		if tick <= float64(to.Tick) {
+			t := (tick - float64(from.Tick)) / float64(to.Tick-from.Tick)
+			return blendPosition(from.Position, to.Position, t), true
+		}
+	}
+
+	// Updates stopped arriving, so keep the entity going in the direction it
+	// was heading for a little while.
+	from, to := self.states[len(self.states)-2], self.states[len(self.states)-1]
+	extrapolated := math.Min(tick-float64(to.Tick), maxExtrapolationTicks)
+	t := 1 + extrapolated/float64(to.Tick-from.Tick)
+	return blendPosition(from.Position, to.Position, t), true
+}
+
+func blendPosition(from, to component.PositionData, t float64) component.PositionData {
+	// Take the shortest way around the circle.
+	angleDelta := math.Remainder(to.Angle-from.Angle, 2*math.Pi)
+	return component.PositionData{
+		X:     from.X + (to.X-from.X)*t,
+		Y:     from.Y + (to.Y-from.Y)*t,
+		Angle: from.Angle + angleDelta*t,
+	}
+}
+
+// Estimates the current tick of the server from the snapshots it sends.
+type serverClock struct {
+	tick       float64
+	lastUpdate time.Time
+}
+
+func (self *serverClock) Advance(now time.Time) {
+	if !self.lastUpdate.IsZero() {
+		self.tick += float64(now.Sub(self.lastUpdate)) / float64(game.TickDuration)
+	}
+	self.lastUpdate = now
+}
+
+func (self *serverClock) Synchronize(tick uint64) {
+	drift := float64(tick) - self.tick
+	// Jump straight to the server's tick when we are way off, otherwise ease
+	// into it so the rendered ships do not stutter.
+	if math.Abs(drift) > 2*interpolationDelayTicks {
+		self.tick = float64(tick)
+		return
+	}
+	self.tick += 0.1 * drift
+}
+
+// The tick at which the remote entities should be rendered.
+func (self *serverClock) RenderTick() float64 {
+	return self.tick - interpolationDelayTicks
+}
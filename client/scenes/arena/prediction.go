@@ -0,0 +1,110 @@
+package arena
+
+import (
+	"astro-blasters/game"
+	"astro-blasters/game/component"
+	"astro-blasters/game/types"
+
+	"github.com/yohamta/donburi"
+)
+
+// Upper bound on how many frames are re-simulated during a reconciliation.
+const maxReplayFrames = 120
+
+type pendingMove struct {
+	Sequence uint32
+	Move     types.PlayerMove
+	Frame    uint64
+}
+
+// Keeps track of the moves that were applied locally but not yet processed
+// by the server, so that they can be replayed on top of the authoritative
+// state sent by the server.
+type predictor struct {
+	frame    uint64
+	sequence uint32
+	pending  []pendingMove
+
+	// The last move processed by the server and the frame at which it was
+	// applied locally.
+	acknowledgedSequence uint32
+	acknowledgedFrame    uint64
+}
+
+func (self *predictor) Record(move types.PlayerMove) pendingMove {
+	self.sequence += 1
+	pending := pendingMove{
+		Sequence: self.sequence,
+		Move:     move,
+		Frame:    self.frame,
+	}
+	self.pending = append(self.pending, pending)
+	return pending
+}
+
+func (self *predictor) Advance() {
+	self.frame += 1
+}
+
+// Rewinds the player to the authoritative position and replays the moves the
+// server has not seen yet. The authoritative position is the one after the
+// server ran `ticksSinceProcessed` ticks since processing the move with the
+// given sequence.
+func (self *predictor) Reconcile(
+	simulation *game.GameSimulation,
+	player *donburi.Entry,
+	authoritative component.PositionData,
+	lastProcessedSequence uint32,
+	ticksSinceProcessed uint64,
+) {
+	component.Position.SetValue(player, authoritative)
+
+	if lastProcessedSequence == 0 {
+		return
+	}
+
+	if lastProcessedSequence != self.acknowledgedSequence {
+		for _, move := range self.pending {
+			if move.Sequence == lastProcessedSequence {
+				self.acknowledgedSequence = move.Sequence
+				self.acknowledgedFrame = move.Frame
+				break
+			}
+		}
+	}
+
+	remaining := self.pending[:0]
+	for _, move := range self.pending {
+		if move.Sequence > lastProcessedSequence {
+			remaining = append(remaining, move)
+		}
+	}
+	self.pending = remaining
+
+	if lastProcessedSequence != self.acknowledgedSequence {
+		return
+	}
+
+	startFrame := self.acknowledgedFrame + ticksSinceProcessed
+	if startFrame > self.frame {
+		startFrame = self.frame
+	}
+	if self.frame-startFrame > maxReplayFrames {
+		startFrame = self.frame - maxReplayFrames
+	}
+
+	playerId := component.Player.Get(player).Id
+	next := 0
+	for frame := startFrame; frame < self.frame; frame++ {
+		for next < len(self.pending) && self.pending[next].Frame <= frame {
+			simulation.RegisterPlayerMove(playerId, self.pending[next].Move)
+			next += 1
+		}
+		simulation.MovePlayer(player)
+	}
+
+	// Moves recorded on the current frame are not part of any step yet.
+	for ; next < len(self.pending); next++ {
+		simulation.RegisterPlayerMove(playerId, self.pending[next].Move)
+	}
+}
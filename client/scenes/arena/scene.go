@@ -5,22 +5,24 @@ import (
 	"astro-blasters/client/config"
 	"astro-blasters/client/scenes"
 	"astro-blasters/client/scenes/common"
+	"astro-blasters/client/scenes/common/failure"
 	"astro-blasters/game"
 	"astro-blasters/game/component"
 	"astro-blasters/game/types"
 	"astro-blasters/rpc"
 	"astro-blasters/server/messages"
 	"context"
+	"errors"
 	"fmt"
 	"image/color"
 	"math"
 	"math/rand/v2"
 	"sort"
+	"sync"
 	"time"
 
 	dmath "github.com/yohamta/donburi/features/math"
 
-	"github.com/coder/websocket"
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/inpututil"
 	"github.com/hajimehoshi/ebiten/v2/text/v2"
@@ -28,7 +30,18 @@ import (
 	"github.com/yohamta/donburi/filter"
 )
 
+// How long an announcement of the server stays on screen.
+const announcementDuration = 8 * time.Second
+
+// How long the answers to the server can take to be written before the
+// connection is considered dead.
+const replyTimeout = time.Second
+
 type ArenaScene struct {
+	// Guards the simulation which is updated both by the game loop and the
+	// messages from the server.
+	mutex sync.Mutex
+
 	background1 *common.Background
 	background2 *common.Background
 	config      *config.ClientConfig
@@ -40,20 +53,48 @@ type ArenaScene struct {
 
 	lastFireTime time.Time
 
-	connection *websocket.Conn
+	connection rpc.Transport
 	player     *donburi.Entry
 	playerName string
 	playerId   types.PlayerId
+	roomCode   string
+
+	sessionToken string
+	// Set when the connection dropped and could not be recovered.
+	disconnectError error
+	// Answers queued by the handlers of the server messages, written once the
+	// lock is released so that a stalled connection does not freeze the game.
+	replies []rpc.BaseMessage
+
+	// Latency to the server, as measured by the server.
+	roundTripTime time.Duration
+	jitter        time.Duration
+
+	// Last message of the operators of the server, shown for a while.
+	announcement      string
+	announcementUntil time.Time
 
 	deathScene *DeathScene
+	predictor  predictor
 
 	isAlive bool
 
+	// Maps the entities on the server to their local counterparts.
+	bullets          map[uint64]donburi.Entity
+	explosions       map[uint64]donburi.Entity
+	lastSnapshotTick uint64
+	snapshots        map[uint64]messages.WorldSnapshot
+
+	// Remote ships are rendered in the past, blended between snapshots.
+	interpolation map[types.PlayerId]*interpolationBuffer
+	clock         serverClock
+
 	scrollOffset int
 }
 
-func NewArenaScene(config *config.ClientConfig, playerName string) *ArenaScene {
+func NewArenaScene(config *config.ClientConfig, playerName string, roomCode string) *ArenaScene {
 	return &ArenaScene{
+		roomCode:    roomCode,
 		background1: common.NewBackground(game.MapWidth, game.MapHeight),
 		background2: common.NewBackground(config.ScreenWidth, config.ScreenHeight),
 		playerName:  playerName,
@@ -61,32 +102,24 @@ func NewArenaScene(config *config.ClientConfig, playerName string) *ArenaScene {
 		deathScene:  NewDeathScene(config),
 		isAlive:     true,
 		config:      config,
+		bullets:     make(map[uint64]donburi.Entity),
+		explosions:  make(map[uint64]donburi.Entity),
+		snapshots:   make(map[uint64]messages.WorldSnapshot),
+
+		interpolation: make(map[types.PlayerId]*interpolationBuffer),
 	}
 }
 
 func (self *ArenaScene) Configure(controller *scenes.AppController) error {
 	controller.ChangeMusic(assets.BattleMusic)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	connection, _, err := websocket.Dial(ctx, self.config.ServerWebsocketURL, nil)
-
+	connection, response, err := self.connect()
 	if err != nil {
-		return fmt.Errorf("Failed to connect to the server at %s", self.config.ServerWebsocketURL)
-	}
-
-	connectionHandshake := rpc.NewBaseMessage(messages.ConnectionHandshake{PlayerName: self.playerName})
-	if err := rpc.WriteMessage(ctx, connection, connectionHandshake); err != nil {
-		return fmt.Errorf("Failed to send handshake to the server at %s", self.config.ServerWebsocketURL)
-	}
-
-	var response messages.ConnectionHandshakeResponse
-	if err := rpc.ReceiveExpectedMessage(ctx, connection, &response); err != nil {
-		return fmt.Errorf("Error receiving handshake response: " + err.Error())
+		return err
 	}
 
 	self.connection = connection
-	self.simulation = game.NewGameSimulation()
+	self.simulation = game.NewGameSimulation(game.SystemClock, time.Now().UnixNano())
 
 	self.simulation.OnBulletCollide = func(player, bullet *donburi.Entry) {
 		if component.Player.Get(player).Id == self.playerId {
@@ -95,23 +128,16 @@ func (self *ArenaScene) Configure(controller *scenes.AppController) error {
 		controller.PlaySfx(assets.Hit)
 	}
 
-	for _, player := range response.PlayerData {
-		if player.PlayerId == response.PlayerId {
-			// Focus the camera on the player.
-			self.player = self.simulation.CreatePlayer(player.PlayerId, &player.Position, player.PlayerName, player.IsConnected)
-			self.playerId = player.PlayerId
-			self.camera.FocusTarget(player.Position)
-			continue
-		}
-
-		self.simulation.CreatePlayer(player.PlayerId, &player.Position, player.PlayerName, player.IsConnected)
-	}
+	self.applyHandshakeResponse(response)
 
 	go self.receiveServerUpdates(controller)
 	return nil
 }
 
 func (self *ArenaScene) Draw(screen *ebiten.Image) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
 	screen.Clear()
 
 	if self.shakeDuration > 0 {
@@ -127,28 +153,76 @@ func (self *ArenaScene) Draw(screen *ebiten.Image) {
 		self.deathScene.Draw(screen)
 	}
 
+	if time.Now().Before(self.announcementUntil) {
+		self.drawAnnouncement(screen)
+	}
+
 	if ebiten.IsKeyPressed(ebiten.KeyL) {
 		self.showLeaderboard(screen)
 	}
 }
 
+func (self *ArenaScene) drawAnnouncement(screen *ebiten.Image) {
+	font := &text.GoTextFace{Source: assets.Munro, Size: 24}
+	width, _ := text.Measure(self.announcement, font, 0)
+
+	opts := &text.DrawOptions{}
+	opts.GeoM.Translate((float64(self.config.ScreenWidth)-width)/2, 100)
+	opts.ColorScale.Scale(1, 0.85, 0.3, 1)
+	text.Draw(screen, self.announcement, font, opts)
+}
+
 func (self *ArenaScene) Update(controller *scenes.AppController) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.disconnectError != nil {
+		controller.ChangeScene(failure.NewFailureScene(self.config, self.disconnectError))
+		return
+	}
+
 	if self.isAlive {
 		self.handleInput()
 	}
 
 	self.simulation.Update()
+	self.predictor.Advance()
+	self.interpolateRemotePlayers()
 
 	position := component.Position.Get(self.player)
 	self.camera.FocusTarget(*position)
 	self.camera.Constrain()
 }
 
+func (self *ArenaScene) interpolateRemotePlayers() {
+	self.clock.Advance(time.Now())
+	renderTick := self.clock.RenderTick()
+
+	for playerId, buffer := range self.interpolation {
+		player := self.simulation.FindCorrespondingPlayer(playerId)
+		if player == nil {
+			continue
+		}
+		if position, ok := buffer.Sample(renderTick); ok {
+			component.Position.SetValue(player, position)
+		}
+	}
+}
+
 func (self *ArenaScene) handleInput() {
 	ctx := context.Background()
 	position := component.Position.Get(self.player)
 	sendMove := func(move types.PlayerMove) {
-		message := rpc.NewBaseMessage(messages.RegisterPlayerMove{Move: move, Position: *position})
+		// Apply the move right away instead of waiting for the server.
+		pending := self.predictor.Record(move)
+		self.simulation.RegisterPlayerMove(self.playerId, move)
+
+		message := rpc.NewBaseMessage(messages.RegisterPlayerMove{
+			Move:     move,
+			Sequence: pending.Sequence,
+			Position: *position,
+			Tick:     uint64(max(self.clock.RenderTick(), 0)),
+		})
 		rpc.WriteMessage(ctx, self.connection, message)
 	}
 
@@ -256,6 +330,14 @@ func (self *ArenaScene) drawEntities(screen *ebiten.Image) {
 				opts := &text.DrawOptions{}
 				opts.GeoM.Translate(10, 10)
 				text.Draw(screen, fmt.Sprintf("Score %d", player.Score), &text.GoTextFace{Source: assets.Munro, Size: 20}, opts)
+
+				opts = &text.DrawOptions{}
+				opts.GeoM.Translate(10, 35)
+				text.Draw(screen, fmt.Sprintf("Room %s", self.roomCode), &text.GoTextFace{Source: assets.Munro, Size: 20}, opts)
+
+				opts = &text.DrawOptions{}
+				opts.GeoM.Translate(10, 60)
+				text.Draw(screen, fmt.Sprintf("Ping %d ms, jitter %d ms", self.roundTripTime.Milliseconds(), self.jitter.Milliseconds()), &text.GoTextFace{Source: assets.Munro, Size: 20}, opts)
 			}
 
 			if player.IsMovingForward {
@@ -367,81 +449,162 @@ func (self *ArenaScene) drawMessage(screen *ebiten.Image, image *ebiten.Image, s
 
 // Receives information from the server and updates the game state accordingly.
 func (self *ArenaScene) receiveServerUpdates(controller *scenes.AppController) {
+	router := self.newRouter(controller)
 	for {
 		var message rpc.BaseMessage
-		if err := rpc.ReceiveMessage(context.Background(), self.connection, &message); err != nil {
+		err := rpc.ReceiveMessage(context.Background(), self.connection, &message)
+		if errors.Is(err, rpc.ErrMalformedMessage) {
 			continue
 		}
 
-		switch message.MessageType {
-		case "UpdatePosition":
-			var updatePosition messages.UpdatePosition
-			if err := rpc.DecodeExpectedMessage(message, &updatePosition); err != nil {
-				continue
-			}
-			if player := self.simulation.FindCorrespondingPlayer(updatePosition.PlayerId); player != nil {
-				component.Position.SetValue(player, updatePosition.Position)
-			}
-		case "EventPlayerConnected":
-			var event messages.EventPlayerConnected
-			if err := rpc.DecodeExpectedMessage(message, &event); err != nil {
-				continue
-			}
-			self.simulation.CreatePlayer(event.PlayerId, &event.Position, event.PlayerName, true)
-		case "EventPlayerDisconnected":
-			var event messages.EventPlayerDisconnected
-			if err := rpc.DecodeExpectedMessage(message, &event); err != nil {
-				continue
-			}
-			player := self.simulation.FindCorrespondingPlayer(event.PlayerId)
-			self.simulation.RegisterPlayerDisconnection(player)
-		case "EventPlayerMove":
-			var event messages.EventPlayerMove
-			if err := rpc.DecodeExpectedMessage(message, &event); err != nil {
-				continue
-			}
-			self.simulation.RegisterPlayerMove(event.PlayerId, event.Move)
-		case "EventUpdateHealth":
-			var event messages.EventUpdateHealth
-			if err := rpc.DecodeExpectedMessage(message, &event); err != nil {
-				continue
-			}
-			self.simulation.UpdatePlayerHealth(event.PlayerId, event.Health)
-		case "EventPlayerDied":
-			var event messages.EventPlayerDied
-			if err := rpc.DecodeExpectedMessage(message, &event); err != nil {
-				continue
+		if err != nil {
+			self.connection.Close()
+			if err := self.reconnect(); err != nil {
+				self.mutex.Lock()
+				self.disconnectError = err
+				self.mutex.Unlock()
+				return
 			}
+			continue
+		}
 
-			killed := self.simulation.FindCorrespondingPlayer(event.PlayerId)
-			killer := self.simulation.FindCorrespondingPlayer(event.KilledBy)
+		self.mutex.Lock()
+		err = router.Dispatch(message)
 
-			self.simulation.RegisterPlayerDeath(killed, killer)
-			if event.PlayerId == self.playerId {
-				self.deathScene = NewDeathScene(self.config)
-				self.isAlive = false
-			}
-			controller.PlaySfx(assets.Explosion)
-		case "EventPlayerFireBullet":
-			var event messages.EventPlayerFireBullet
-			if err := rpc.DecodeExpectedMessage(message, &event); err != nil {
-				continue
-			}
-			self.simulation.RegisterPlayerFire(self.simulation.FindCorrespondingPlayer(event.PlayerId))
-			controller.PlaySfx(assets.LaserAudio)
-		case "EventPlayerRespawned":
-			var event messages.EventPlayerRespawned
-			if err := rpc.DecodeExpectedMessage(message, &event); err != nil {
-				continue
-			}
+		// The server dropped us on purpose, coming back would not help.
+		var disconnected messages.Disconnected
+		if errors.As(err, &disconnected) {
+			self.connection.Close()
+			self.disconnectError = disconnected
+			self.mutex.Unlock()
+			return
+		}
+		replies := self.replies
+		self.replies = nil
+		self.mutex.Unlock()
+
+		self.sendReplies(replies)
+	}
+}
+
+// Writes the answers of the handlers. A connection that can not take them in
+// time is closed, and the next read reconnects.
+func (self *ArenaScene) sendReplies(replies []rpc.BaseMessage) {
+	if len(replies) == 0 {
+		return
+	}
 
-			self.simulation.RespawnPlayer(self.simulation.FindCorrespondingPlayer(event.PlayerId), event.Position)
-			self.isAlive = true
-		default:
+	ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+	defer cancel()
+	for _, reply := range replies {
+		if err := rpc.WriteMessage(ctx, self.connection, reply); err != nil {
+			self.connection.Close()
+			return
 		}
 	}
 }
 
+// Builds the handlers of the server messages, which run with the lock held.
+// Events about a player we do not know yet are dropped, the next snapshot
+// brings the player along with its state.
+func (self *ArenaScene) newRouter(controller *scenes.AppController) *rpc.Router {
+	router := rpc.NewRouter()
+	rpc.Handle(router, func(disconnected messages.Disconnected) error {
+		return disconnected
+	})
+	rpc.Handle(router, func(event messages.EventPlayerConnected) error {
+		// The id may have belonged to an evicted player we still know about.
+		if player := self.simulation.FindCorrespondingPlayer(event.PlayerId); player != nil {
+			self.simulation.RemovePlayer(player)
+			delete(self.interpolation, event.PlayerId)
+		}
+		self.simulation.CreatePlayer(event.PlayerId, &event.Position, event.PlayerName, true)
+		return nil
+	})
+	rpc.Handle(router, func(event messages.EventPlayerReconnected) error {
+		if player := self.simulation.FindCorrespondingPlayer(event.PlayerId); player != nil {
+			self.simulation.RegisterPlayerReconnection(player)
+		}
+		return nil
+	})
+	rpc.Handle(router, func(event messages.EventPlayerDisconnected) error {
+		if player := self.simulation.FindCorrespondingPlayer(event.PlayerId); player != nil {
+			self.simulation.RegisterPlayerDisconnection(player)
+		}
+		return nil
+	})
+	rpc.Handle(router, func(event messages.EventPlayerMove) error {
+		// Our own moves are already predicted locally.
+		if event.PlayerId == self.playerId {
+			return nil
+		}
+		return self.simulation.RegisterPlayerMove(event.PlayerId, event.Move)
+	})
+	rpc.Handle(router, func(event messages.EventUpdateHealth) error {
+		return self.simulation.UpdatePlayerHealth(event.PlayerId, event.Health)
+	})
+	rpc.Handle(router, func(event messages.EventPlayerDied) error {
+		killed := self.simulation.FindCorrespondingPlayer(event.PlayerId)
+		killer := self.simulation.FindCorrespondingPlayer(event.KilledBy)
+		if killed != nil {
+			self.simulation.RegisterPlayerDeath(killed, killer)
+		}
+		if event.PlayerId == self.playerId {
+			self.deathScene = NewDeathScene(self.config)
+			self.isAlive = false
+		}
+		controller.PlaySfx(assets.Explosion)
+		return nil
+	})
+	rpc.Handle(router, func(event messages.EventPlayerFireBullet) error {
+		player := self.simulation.FindCorrespondingPlayer(event.PlayerId)
+		if player == nil {
+			return nil
+		}
+		self.simulation.RegisterPlayerFire(player)
+		controller.PlaySfx(assets.LaserAudio)
+		return nil
+	})
+	rpc.Handle(router, func(event messages.EventPlayerRespawned) error {
+		if player := self.simulation.FindCorrespondingPlayer(event.PlayerId); player != nil {
+			self.simulation.RespawnPlayer(player, event.Position)
+		}
+		self.isAlive = true
+		return nil
+	})
+	rpc.Handle(router, func(announcement messages.ServerAnnouncement) error {
+		self.announcement = announcement.Message
+		self.announcementUntil = time.Now().Add(announcementDuration)
+		return nil
+	})
+	rpc.Handle(router, func(shuttingDown messages.ServerShuttingDown) error {
+		self.announcement = shuttingDown.Reason
+		if shuttingDown.Countdown > 0 {
+			self.announcement = fmt.Sprintf("%s in %s", shuttingDown.Reason, shuttingDown.Countdown)
+		}
+		self.announcementUntil = time.Now().Add(max(announcementDuration, shuttingDown.Countdown))
+		return nil
+	})
+	rpc.Handle(router, func(heartbeat messages.Heartbeat) error {
+		self.roundTripTime = heartbeat.RoundTripTime
+		self.jitter = heartbeat.Jitter
+		self.replies = append(self.replies, rpc.NewBaseMessage(messages.HeartbeatAck{
+			Sequence: heartbeat.Sequence,
+			SentAt:   heartbeat.SentAt,
+		}))
+		return nil
+	})
+	rpc.Handle(router, func(snapshot messages.WorldSnapshot) error {
+		self.receiveSnapshot(snapshot)
+		return nil
+	})
+	rpc.Handle(router, func(delta messages.WorldSnapshotDelta) error {
+		self.receiveSnapshotDelta(delta)
+		return nil
+	})
+	return router
+}
+
 type leaderboardEntry struct {
 	Name  string
 	Score int
@@ -0,0 +1,191 @@
+package arena
+
+import (
+	"astro-blasters/game/component"
+	"astro-blasters/game/types"
+	"astro-blasters/rpc"
+	"astro-blasters/server/messages"
+
+	"github.com/yohamta/donburi"
+	"github.com/yohamta/donburi/filter"
+)
+
+// Radius in which a locally simulated entity is considered to be the same as
+// the one reported by the server.
+const adoptionRadius = 50
+
+// How many ticks worth of past snapshots are kept around to apply the deltas
+// from the server. This outlives the history that the server keeps.
+const snapshotHistoryTicks = 256
+
+// Reconstructs the snapshot from the delta against one we have acknowledged.
+func (self *ArenaScene) receiveSnapshotDelta(delta messages.WorldSnapshotDelta) {
+	base, ok := self.snapshots[delta.BaseTick]
+	if !ok {
+		return
+	}
+	self.receiveSnapshot(messages.ApplySnapshotDelta(base, delta))
+}
+
+func (self *ArenaScene) receiveSnapshot(snapshot messages.WorldSnapshot) {
+	// Snapshots may arrive out of order, an older one would only rewind the world.
+	if snapshot.Tick <= self.lastSnapshotTick {
+		return
+	}
+
+	self.snapshots[snapshot.Tick] = snapshot
+	for tick := range self.snapshots {
+		if tick+snapshotHistoryTicks < snapshot.Tick {
+			delete(self.snapshots, tick)
+		}
+	}
+
+	self.applySnapshot(snapshot)
+
+	self.replies = append(self.replies, rpc.NewBaseMessage(messages.AcknowledgeSnapshot{Tick: snapshot.Tick}))
+}
+
+// Overwrites the local simulation with the authoritative state of the server.
+func (self *ArenaScene) applySnapshot(snapshot messages.WorldSnapshot) {
+	self.lastSnapshotTick = snapshot.Tick
+	self.clock.Synchronize(snapshot.Tick)
+
+	world := self.simulation.ECS.World
+
+	seenPlayers := make(map[types.PlayerId]bool)
+	for _, snapshotPlayer := range snapshot.Players {
+		seenPlayers[snapshotPlayer.Player.Id] = true
+
+		player := self.simulation.FindCorrespondingPlayer(snapshotPlayer.Player.Id)
+		if player == nil {
+			player = self.simulation.CreatePlayer(snapshotPlayer.Player.Id, &snapshotPlayer.Position, snapshotPlayer.Player.Name, snapshotPlayer.Player.IsConnected)
+		}
+
+		component.Player.SetValue(player, snapshotPlayer.Player)
+
+		if snapshotPlayer.Player.Id == self.playerId {
+			if self.isAlive && !snapshotPlayer.Player.IsAlive {
+				self.deathScene = NewDeathScene(self.config)
+			}
+			self.isAlive = snapshotPlayer.Player.IsAlive
+
+			var ticksSinceProcessed uint64
+			if snapshot.Tick > snapshot.LastProcessedTick {
+				ticksSinceProcessed = snapshot.Tick - snapshot.LastProcessedTick
+			}
+			self.predictor.Reconcile(self.simulation, player, snapshotPlayer.Position, snapshot.LastProcessedSequence, ticksSinceProcessed)
+			continue
+		}
+
+		buffer, ok := self.interpolation[snapshotPlayer.Player.Id]
+		if !ok {
+			buffer = &interpolationBuffer{}
+			self.interpolation[snapshotPlayer.Player.Id] = buffer
+		}
+		buffer.Push(snapshot.Tick, snapshotPlayer.Position)
+	}
+
+	// Players that did not come back in time are evicted by the server.
+	evicted := []*donburi.Entry{}
+	for player := range donburi.NewQuery(filter.Contains(component.Player)).Iter(world) {
+		playerId := component.Player.Get(player).Id
+		if playerId != self.playerId && !seenPlayers[playerId] {
+			evicted = append(evicted, player)
+		}
+	}
+	for _, player := range evicted {
+		delete(self.interpolation, component.Player.Get(player).Id)
+		self.simulation.RemovePlayer(player)
+	}
+
+	seenBullets := make(map[uint64]bool)
+	for _, snapshotBullet := range snapshot.Bullets {
+		seenBullets[snapshotBullet.Id] = true
+
+		if entity, ok := self.bullets[snapshotBullet.Id]; ok && world.Valid(entity) {
+			component.Position.SetValue(world.Entry(entity), snapshotBullet.Position)
+			continue
+		}
+
+		// The bullet might have already been fired locally through an event.
+		bullet := self.findUnclaimedEntity(component.Bullet, self.bullets, snapshotBullet.Position, func(entry *donburi.Entry) bool {
+			return component.Bullet.Get(entry).FiredBy == snapshotBullet.FiredBy
+		})
+
+		if bullet == nil {
+			shooter := self.simulation.FindCorrespondingPlayer(snapshotBullet.FiredBy)
+			if shooter == nil {
+				continue
+			}
+			bullet = self.simulation.FireBullet(shooter, snapshotBullet.Position)
+		}
+
+		component.Position.SetValue(bullet, snapshotBullet.Position)
+		self.bullets[snapshotBullet.Id] = bullet.Entity()
+	}
+
+	for id, entity := range self.bullets {
+		if seenBullets[id] {
+			continue
+		}
+		if world.Valid(entity) {
+			world.Remove(entity)
+		}
+		delete(self.bullets, id)
+	}
+
+	// Explosions are purely cosmetic, so only the ones we have not spawned
+	// ourselves are created and they are left to expire on their own.
+	seenExplosions := make(map[uint64]bool)
+	for _, snapshotExplosion := range snapshot.Explosions {
+		seenExplosions[snapshotExplosion.Id] = true
+		if _, ok := self.explosions[snapshotExplosion.Id]; ok {
+			continue
+		}
+
+		explosion := self.findUnclaimedEntity(component.Explosion, self.explosions, snapshotExplosion.Position, nil)
+		if explosion == nil {
+			explosion = self.simulation.CreateExplosion(&snapshotExplosion.Position, snapshotExplosion.Count)
+		}
+		self.explosions[snapshotExplosion.Id] = explosion.Entity()
+	}
+
+	for id := range self.explosions {
+		if !seenExplosions[id] {
+			delete(self.explosions, id)
+		}
+	}
+}
+
+// Finds the closest entity with the given component that is near the position
+// and is not yet associated with an entity on the server.
+func (self *ArenaScene) findUnclaimedEntity(
+	componentType donburi.IComponentType,
+	claimed map[uint64]donburi.Entity,
+	position component.PositionData,
+	predicate func(entry *donburi.Entry) bool,
+) *donburi.Entry {
+	isClaimed := make(map[donburi.Entity]bool, len(claimed))
+	for _, entity := range claimed {
+		isClaimed[entity] = true
+	}
+
+	var closest *donburi.Entry
+	closestDistance := float64(adoptionRadius * adoptionRadius)
+
+	query := donburi.NewQuery(filter.Contains(componentType, component.Position))
+	for entry := range query.Iter(self.simulation.ECS.World) {
+		if isClaimed[entry.Entity()] || (predicate != nil && !predicate(entry)) {
+			continue
+		}
+
+		entryPosition := component.Position.Get(entry)
+		distance := (entryPosition.X-position.X)*(entryPosition.X-position.X) + (entryPosition.Y-position.Y)*(entryPosition.Y-position.Y)
+		if distance <= closestDistance {
+			closest = entry
+			closestDistance = distance
+		}
+	}
+
+	return closest
+}
@@ -4,6 +4,8 @@ import (
 	"astro-blasters/assets"
 	"astro-blasters/client/config"
 	"astro-blasters/client/scenes"
+	"astro-blasters/server/messages"
+	"errors"
 	"os"
 	"sync"
 	"time"
@@ -39,7 +41,18 @@ func (self *FailureScene) Draw(screen *ebiten.Image) {
 	screen.DrawImage(assets.Borders.GetTile(assets.TileIndex{X: 1, Y: 3}), opts1)
 	screen.DrawImage(assets.Borders.GetTile(assets.TileIndex{X: 0, Y: 1}), opts1)
 
-	drawText(screen, self.error.Error(), font, 30, float64(self.config.ScreenWidth)/2, 275, 10, [4]float32{255, 255, 255, 255})
+	// Show why the server refused us rather than just the message.
+	var rejection messages.HandshakeRejected
+	var disconnected messages.Disconnected
+	if errors.As(self.error, &rejection) {
+		drawText(screen, rejectionTitle(rejection.Reason), font, 36, float64(self.config.ScreenWidth)/2, 245, 10, [4]float32{255, 255, 255, 255})
+		drawText(screen, rejection.Message, font, 24, float64(self.config.ScreenWidth)/2, 295, 10, [4]float32{255, 255, 255, 255})
+	} else if errors.As(self.error, &disconnected) {
+		drawText(screen, disconnectTitle(disconnected.Reason), font, 36, float64(self.config.ScreenWidth)/2, 245, 10, [4]float32{255, 255, 255, 255})
+		drawText(screen, disconnected.Message, font, 24, float64(self.config.ScreenWidth)/2, 295, 10, [4]float32{255, 255, 255, 255})
+	} else {
+		drawText(screen, self.error.Error(), font, 30, float64(self.config.ScreenWidth)/2, 275, 10, [4]float32{255, 255, 255, 255})
+	}
 	if self.visible {
 		drawText(screen, "Press C To Close the Game", font, 30, float64(self.config.ScreenWidth)/2, float64(self.config.ScreenHeight)-300, 10, [4]float32{255, 255, 255, 255})
 	}
@@ -60,6 +73,46 @@ func (self *FailureScene) Update(controller *scenes.AppController) {
 	}
 }
 
+func rejectionTitle(reason messages.RejectionReason) string {
+	switch reason {
+	case messages.RejectRoomNotFound:
+		return "Room not found"
+	case messages.RejectRoomFull:
+		return "Room full"
+	case messages.RejectIncompatibleVersion:
+		return "Incompatible version"
+	case messages.RejectBanned:
+		return "Banned"
+	case messages.RejectShuttingDown:
+		return "Server shutting down"
+	case messages.RejectTooManyRooms:
+		return "Too many rooms"
+	case messages.RejectRateLimited:
+		return "Slow down"
+	}
+	return "Connection refused"
+}
+
+func disconnectTitle(reason messages.DisconnectReason) string {
+	switch reason {
+	case messages.DisconnectRateLimited:
+		return "Too many messages"
+	case messages.DisconnectCheating:
+		return "Kicked"
+	case messages.DisconnectBanned:
+		return "Banned"
+	case messages.DisconnectKicked:
+		return "Kicked"
+	case messages.DisconnectServerError:
+		return "Server error"
+	case messages.DisconnectServerShutdown:
+		return "Server shut down"
+	case messages.DisconnectMessageTooLarge:
+		return "Message too large"
+	}
+	return "Disconnected"
+}
+
 func (self *FailureScene) Configure(controller *scenes.AppController) error {
 	return nil
 }
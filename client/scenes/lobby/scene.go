@@ -0,0 +1,216 @@
+package lobby
+
+import (
+	"astro-blasters/assets"
+	"astro-blasters/client/config"
+	"astro-blasters/client/scenes"
+	"astro-blasters/client/scenes/arena"
+	"astro-blasters/client/scenes/common"
+	"astro-blasters/client/scenes/common/failure"
+	"astro-blasters/rpc"
+	"astro-blasters/server/messages"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+	"github.com/hajimehoshi/ebiten/v2/text/v2"
+)
+
+const (
+	roomCodeLength  = 5
+	maxVisibleRooms = 5
+)
+
+type LobbyScene struct {
+	config     *config.ClientConfig
+	background *common.Background
+	once       sync.Once
+	playerName string
+
+	rooms    []messages.RoomInfo
+	selected int
+
+	isTypingCode bool
+	roomCode     string
+}
+
+func NewLobbyScene(config *config.ClientConfig, playerName string) *LobbyScene {
+	return &LobbyScene{
+		config:     config,
+		background: common.NewBackground(config.ScreenWidth, config.ScreenHeight),
+		playerName: playerName,
+	}
+}
+
+func (self *LobbyScene) Configure(controller *scenes.AppController) error {
+	return self.refreshRooms()
+}
+
+func (self *LobbyScene) Draw(screen *ebiten.Image) {
+	screen.Clear()
+	screen.DrawImage(self.background.Image, nil)
+
+	fontface := text.GoTextFace{Source: assets.MunroNarrow}
+	lineSpacing := 10
+
+	self.drawTransformedImage(screen, assets.Borders.GetTile(assets.TileIndex{X: 1, Y: 3}), 60, 25, 0, 50, 120)
+	self.drawTransformedImage(screen, assets.Borders.GetTile(assets.TileIndex{X: 0, Y: 1}), 60, 25, 0, 50, 120)
+
+	self.drawText(screen, "Choose your battlefield", fontface, 50, 530, 180, lineSpacing)
+
+	if len(self.rooms) == 0 {
+		self.drawText(screen, "No rooms yet, press N to create one.", fontface, 30, 530, 260, lineSpacing)
+	}
+
+	// Keep the selected room in view.
+	first := max(0, self.selected-maxVisibleRooms+1)
+	for i := first; i < len(self.rooms) && i < first+maxVisibleRooms; i++ {
+		room := self.rooms[i]
+		line := fmt.Sprintf("%s   %d players", room.RoomCode, room.PlayerCount)
+		if i == self.selected && !self.isTypingCode {
+			line = fmt.Sprintf("> %s <", line)
+		}
+		self.drawText(screen, line, fontface, 35, 530, float64(260+(i-first)*45), lineSpacing)
+	}
+
+	if self.isTypingCode {
+		self.drawText(screen, fmt.Sprintf("Room code > %s", self.roomCode), fontface, 35, 530, 500, lineSpacing)
+		self.drawText(screen, "Press 'Enter' to join or 'Esc' to go back.", fontface, 27, float64(self.config.ScreenWidth)/2, float64(self.config.ScreenHeight)-120, lineSpacing)
+		return
+	}
+
+	self.drawText(screen, "Up/Down to select a room and 'Enter' to join it.", fontface, 27, float64(self.config.ScreenWidth)/2, float64(self.config.ScreenHeight)-160, lineSpacing)
+	self.drawText(screen, "'N' creates a room, 'J' joins by code and 'R' refreshes.", fontface, 27, float64(self.config.ScreenWidth)/2, float64(self.config.ScreenHeight)-120, lineSpacing)
+}
+
+func (self *LobbyScene) Update(controller *scenes.AppController) {
+	if self.isTypingCode {
+		self.updateRoomCode(controller)
+		return
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyUp) && self.selected > 0 {
+		self.selected -= 1
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyDown) && self.selected < len(self.rooms)-1 {
+		self.selected += 1
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyEnter) && len(self.rooms) > 0 {
+		self.joinRoom(controller, self.rooms[self.selected].RoomCode)
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyJ) {
+		self.isTypingCode = true
+		self.roomCode = ""
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyR) {
+		if err := self.refreshRooms(); err != nil {
+			controller.ChangeScene(failure.NewFailureScene(self.config, err))
+		}
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyN) {
+		var response messages.CreateRoomResponse
+		if err := request(self.config, messages.CreateRoom{ProtocolVersion: messages.ProtocolVersion}, &response); err != nil {
+			controller.ChangeScene(failure.NewFailureScene(self.config, err))
+			return
+		}
+		self.joinRoom(controller, response.RoomCode)
+	}
+}
+
+func (self *LobbyScene) updateRoomCode(controller *scenes.AppController) {
+	for _, r := range ebiten.AppendInputChars(nil) {
+		if len(self.roomCode) < roomCodeLength {
+			self.roomCode += strings.ToUpper(string(r))
+		}
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyBackspace) && len(self.roomCode) > 0 {
+		self.roomCode = self.roomCode[:len(self.roomCode)-1]
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyEscape) {
+		self.isTypingCode = false
+	}
+
+	if inpututil.IsKeyJustPressed(ebiten.KeyEnter) && len(self.roomCode) == roomCodeLength {
+		self.joinRoom(controller, self.roomCode)
+	}
+}
+
+func (self *LobbyScene) joinRoom(controller *scenes.AppController, roomCode string) {
+	self.once.Do(
+		func() {
+			controller.ChangeScene(arena.NewArenaScene(self.config, self.playerName, roomCode))
+		})
+}
+
+func (self *LobbyScene) refreshRooms() error {
+	var response messages.ListRoomsResponse
+	if err := request(self.config, messages.ListRooms{ProtocolVersion: messages.ProtocolVersion}, &response); err != nil {
+		return err
+	}
+
+	self.rooms = response.Rooms
+	self.selected = min(self.selected, max(len(self.rooms)-1, 0))
+	return nil
+}
+
+// Sends a single request to the server over a short-lived connection and
+// waits for the response.
+func request[Response any](config *config.ClientConfig, message any, response *Response) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	connection, err := rpc.Dial(ctx, config.ServerURL)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to the server at %s", config.ServerURL)
+	}
+	defer connection.Close()
+
+	if err := rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(message)); err != nil {
+		return fmt.Errorf("Failed to send a request to the server at %s", config.ServerURL)
+	}
+
+	var received rpc.BaseMessage
+	if err := rpc.ReceiveMessage(ctx, connection, &received); err != nil {
+		return fmt.Errorf("Error receiving the response of the server: " + err.Error())
+	}
+
+	// Shown as is by the failure scene.
+	var rejection messages.HandshakeRejected
+	if rpc.DecodeExpectedMessage(received, &rejection) == nil {
+		return rejection
+	}
+	if err := rpc.DecodeExpectedMessage(received, response); err != nil {
+		return fmt.Errorf("Error receiving the response of the server: " + err.Error())
+	}
+
+	return nil
+}
+
+func (self *LobbyScene) drawTransformedImage(screen *ebiten.Image, image *ebiten.Image, scaleX, scaleY, rotate, translateX, translateY float64) {
+	opts := &ebiten.DrawImageOptions{}
+	opts.GeoM.Scale(scaleX, scaleY)
+	opts.GeoM.Rotate(rotate) // Rotation in radians; use 0 for no rotation
+	opts.GeoM.Translate(translateX, translateY)
+	screen.DrawImage(image, opts)
+}
+
+func (self *LobbyScene) drawText(screen *ebiten.Image, msg string, fontface text.GoTextFace, fontSize float64, x, y float64, lineSpacing int) {
+	fontface.Size = fontSize
+	width, height := text.Measure(msg, &fontface, 10)
+
+	opts := &text.DrawOptions{}
+	opts.LineSpacing = float64(lineSpacing)
+	opts.GeoM.Translate(-width/2, -height/2)
+	opts.GeoM.Translate(x, y)
+	text.Draw(screen, msg, &fontface, opts)
+}
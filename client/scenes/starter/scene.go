@@ -4,8 +4,8 @@ import (
 	"astro-blasters/assets"
 	"astro-blasters/client/config"
 	"astro-blasters/client/scenes"
-	"astro-blasters/client/scenes/arena"
 	"astro-blasters/client/scenes/common"
+	"astro-blasters/client/scenes/lobby"
 	"fmt"
 	"image/color"
 	"sync"
@@ -124,7 +124,7 @@ func (self *StarterScene) Update(controller *scenes.AppController) {
 	if ebiten.IsKeyPressed(ebiten.KeyEscape) {
 		self.once.Do(
 			func() {
-				controller.ChangeScene(arena.NewArenaScene(self.config, self.inputText))
+				controller.ChangeScene(lobby.NewLobbyScene(self.config, self.inputText))
 			})
 	}
 }
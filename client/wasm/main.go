@@ -30,9 +30,9 @@ func main() {
 	serverWebsocketUrl := fmt.Sprintf("ws://%s/play/ws", serverUrl)
 
 	config := config.ClientConfig{
-		ScreenWidth:        1080,
-		ScreenHeight:       720,
-		ServerWebsocketURL: serverWebsocketUrl,
+		ScreenWidth:  1080,
+		ScreenHeight: 720,
+		ServerURL:    serverWebsocketUrl,
 	}
 
 	app := client.NewApp(&config)
@@ -3,28 +3,136 @@ package main
 import (
 	"astro-blasters/client"
 	"astro-blasters/client/config"
+	"astro-blasters/game"
+	"astro-blasters/rpc"
 	"astro-blasters/server"
+	"astro-blasters/server/anticheat"
+	serverconfig "astro-blasters/server/config"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
+// How long the rooms have to close once the shutdown countdown is over.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	rootCmd := &cobra.Command{Use: "cli"}
 
 	// Server command
 	{
 		var port int
+		var snapshotRate int
+		var lagCompensationWindow time.Duration
+		var sessionSecret string
+		var reconnectGracePeriod time.Duration
+		var maxPlayers int
+		var maxRooms int
+		var maxMessageSize int64
+		var tcpPort int
+		var serverCodec string
+		var heartbeatInterval time.Duration
+		var maxMissedHeartbeats int
+		var sendQueueSize int
+		rateLimits := map[string]*string{}
+		var maxRateViolations int
+		var rateViolationWindow time.Duration
+		var fireCooldown time.Duration
+		var antiCheat anticheat.Config
+		var cheatAction string
+		var adminToken string
+		var bansFile string
+		var logLevel string
+		var logFormat string
+		var shutdownCountdown time.Duration
 		serverCmd := &cobra.Command{
 			Use:   "server",
 			Short: "Run the server",
 			Run: func(cmd *cobra.Command, args []string) {
+				logger, err := server.NewLogger(logFormat, logLevel)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				slog.SetDefault(logger)
+
+				if snapshotRate <= 0 {
+					fmt.Println("The snapshot rate must be positive")
+					os.Exit(1)
+				}
+				if maxPlayers <= 0 {
+					fmt.Println("The maximum number of players must be positive")
+					os.Exit(1)
+				}
+				// The shooter must still be around when its last bullet lands.
+				if reconnectGracePeriod < game.BulletLifetime {
+					fmt.Printf("The reconnect grace period must be at least the bullet lifetime (%s)\n", game.BulletLifetime)
+					os.Exit(1)
+				}
+				if maxRooms <= 0 {
+					fmt.Println("The maximum number of rooms must be positive")
+					os.Exit(1)
+				}
+				if maxMessageSize <= 0 {
+					fmt.Println("The maximum message size must be positive")
+					os.Exit(1)
+				}
+				if heartbeatInterval <= 0 || maxMissedHeartbeats <= 0 {
+					fmt.Println("The heartbeat interval and the maximum number of missed heartbeats must be positive")
+					os.Exit(1)
+				}
+				if sendQueueSize <= 0 {
+					fmt.Println("The send queue size must be positive")
+					os.Exit(1)
+				}
+				if maxRateViolations < 0 || rateViolationWindow <= 0 {
+					fmt.Println("The maximum number of rate violations can not be negative and their window must be positive")
+					os.Exit(1)
+				}
+				limits := map[string]serverconfig.RateLimit{}
+				for name, value := range rateLimits {
+					limit, err := serverconfig.ParseRateLimit(*value)
+					if err != nil {
+						fmt.Println(err)
+						os.Exit(1)
+					}
+					limits[name] = limit
+				}
+				if fireCooldown < 0 {
+					fmt.Println("The fire cooldown can not be negative")
+					os.Exit(1)
+				}
+				if antiCheat.MaxViolations < 0 || antiCheat.ViolationWindow <= 0 || antiCheat.BanDuration <= 0 {
+					fmt.Println("The maximum number of cheat violations can not be negative, their window and the ban duration must be positive")
+					os.Exit(1)
+				}
+				action, err := anticheat.ParseAction(cheatAction)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				antiCheat.Action = action
+				if shutdownCountdown < 0 {
+					fmt.Println("The shutdown countdown can not be negative")
+					os.Exit(1)
+				}
+				if serverCodec != "" {
+					if _, err := rpc.CodecByName(serverCodec); err != nil {
+						fmt.Println(err)
+						os.Exit(1)
+					}
+				}
 
 				var stderr bytes.Buffer
 
@@ -55,14 +163,97 @@ func main() {
 					}
 				}
 
-				server := server.NewServer()
-				if err := server.Start(port); err != nil {
+				config := serverconfig.ServerConfig{
+					SnapshotRate:          snapshotRate,
+					LagCompensationWindow: lagCompensationWindow,
+					SessionSecret:         sessionSecret,
+					ReconnectGracePeriod:  reconnectGracePeriod,
+					MaxPlayers:            maxPlayers,
+					MaxRooms:              maxRooms,
+					MaxMessageSize:        maxMessageSize,
+					Codec:                 serverCodec,
+					HeartbeatInterval:     heartbeatInterval,
+					MaxMissedHeartbeats:   maxMissedHeartbeats,
+					SendQueueSize:         sendQueueSize,
+					MoveRateLimit:         limits["move"],
+					AcknowledgeRateLimit:  limits["ack"],
+					HeartbeatAckRateLimit: limits["heartbeat"],
+					DefaultRateLimit:      limits["default"],
+					LobbyRateLimit:        limits["lobby"],
+					MaxRateViolations:     maxRateViolations,
+					RateViolationWindow:   rateViolationWindow,
+					FireCooldown:          fireCooldown,
+					AntiCheat:             antiCheat,
+					AdminToken:            adminToken,
+					BansFile:              bansFile,
+					ShutdownCountdown:     shutdownCountdown,
+				}
+
+				server, err := server.NewServer(&config)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+				if tcpPort != 0 {
+					go func() {
+						if err := server.StartTCP(ctx, tcpPort); err != nil {
+							fmt.Println(err)
+							os.Exit(1)
+						}
+					}()
+				}
+				if err := server.Start(ctx, port); err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				// A second signal kills the server without waiting.
+				stop()
+
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownCountdown+shutdownTimeout)
+				defer cancel()
+				if err := server.Shutdown(ctx, "The server is shutting down"); err != nil {
 					fmt.Println(err)
 					os.Exit(1)
 				}
 			},
 		}
 		serverCmd.Flags().IntVarP(&port, "port", "p", 8080, "Port to run the server on")
+		serverCmd.Flags().IntVar(&tcpPort, "tcp-port", 0, "Port to also accept raw TCP connections on, disabled when 0")
+		serverCmd.Flags().DurationVar(&heartbeatInterval, "heartbeat-interval", time.Second, "How often the clients are pinged")
+		serverCmd.Flags().IntVar(&maxMissedHeartbeats, "max-missed-heartbeats", 5, "How many heartbeats in a row a client can leave unanswered before being dropped")
+		serverCmd.Flags().StringVar(&serverCodec, "codec", "", "Codec used with the clients that support it (msgpack or json), the choice of each client when empty")
+		serverCmd.Flags().IntVar(&snapshotRate, "snapshot-rate", 20, "Number of world snapshots sent to the clients per second")
+		serverCmd.Flags().DurationVar(&lagCompensationWindow, "lag-compensation", 200*time.Millisecond, "How far back bullet collisions are rewound for high latency players")
+		serverCmd.Flags().StringVar(&sessionSecret, "session-secret", "", "Secret used to sign session tokens, random when empty")
+		serverCmd.Flags().DurationVar(&reconnectGracePeriod, "reconnect-grace", 30*time.Second, "How long a disconnected player can reconnect and keep its ship")
+		serverCmd.Flags().IntVar(&maxPlayers, "max-players", 16, "Maximum number of players in a room")
+		serverCmd.Flags().IntVar(&maxRooms, "max-rooms", 64, "Maximum number of rooms open at once")
+		serverCmd.Flags().IntVar(&sendQueueSize, "send-queue-size", 256, "How many messages can wait to be sent to a client before it is disconnected")
+		for _, limit := range []struct{ name, value, usage string }{
+			{"move", "30:20", "moves"},
+			{"ack", "60:20", "snapshot acknowledgements"},
+			{"heartbeat", "5:5", "heartbeat answers"},
+			{"default", "5:5", "any other message"},
+			{"lobby", "1:5", "lobby requests"},
+		} {
+			rateLimits[limit.name] = serverCmd.Flags().String("rate-limit-"+limit.name, limit.value, "Messages per second and burst allowed for "+limit.usage+" of a client, as rate:burst")
+		}
+		serverCmd.Flags().IntVar(&maxRateViolations, "max-rate-violations", 50, "How many messages over the rate limits a client can send within the window before being disconnected")
+		serverCmd.Flags().DurationVar(&rateViolationWindow, "rate-violation-window", 10*time.Second, "Window over which the messages over the rate limits are counted")
+		serverCmd.Flags().DurationVar(&fireCooldown, "fire-cooldown", 300*time.Millisecond, "How long a player waits between two shots")
+		serverCmd.Flags().DurationVar(&antiCheat.MoveTolerance, "move-tolerance", 250*time.Millisecond, "How far, in time of movement, the position of a client can be from the server one on top of its latency, which counts for 480ms at most")
+		serverCmd.Flags().DurationVar(&antiCheat.MinFireInterval, "min-fire-interval", 50*time.Millisecond, "Shortest time between two presses of the trigger before the client is suspected of cheating")
+		serverCmd.Flags().IntVar(&antiCheat.MaxViolations, "max-cheat-violations", 20, "How many cheat violations a client can commit within the window before the cheat action is taken")
+		serverCmd.Flags().DurationVar(&antiCheat.ViolationWindow, "cheat-violation-window", 30*time.Second, "Window over which the cheat violations are counted")
+		serverCmd.Flags().StringVar(&cheatAction, "cheat-action", "correct", "What happens to the clients over the cheat violations: correct, kick or ban")
+		serverCmd.Flags().DurationVar(&antiCheat.BanDuration, "ban-duration", 10*time.Minute, "How long cheaters are banned for when the cheat action is ban")
+		serverCmd.Flags().StringVar(&adminToken, "admin-token", "", "Bearer token of the /admin API, disabled when empty")
+		serverCmd.Flags().StringVar(&bansFile, "bans-file", "bans.json", "File the bans are kept in across restarts, none when empty")
+		serverCmd.Flags().StringVar(&logLevel, "log-level", "info", "Lowest level of the logged messages: debug, info, warn or error")
+		serverCmd.Flags().StringVar(&logFormat, "log-format", "text", "Format of the logs, text or json")
+		serverCmd.Flags().DurationVar(&shutdownCountdown, "shutdown-countdown", 5*time.Second, "How long the clients are warned before the server shuts down")
+		serverCmd.Flags().Int64Var(&maxMessageSize, "max-message-size", rpc.DefaultMaxMessageSize, "Size in bytes of the largest message accepted from a client")
 
 		rootCmd.AddCommand(serverCmd)
 	}
@@ -72,6 +263,8 @@ func main() {
 		var port int
 		var address string
 		var secure bool
+		var tcp bool
+		var clientCodec string
 		clientCmd := &cobra.Command{
 			Use:   "client",
 			Short: "Run the native client",
@@ -81,11 +274,20 @@ func main() {
 					protocol = "wss"
 				}
 
+				if _, err := rpc.CodecByName(clientCodec); err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+
 				url := fmt.Sprintf("%s://%s:%d/play/ws", protocol, address, port)
+				if tcp {
+					url = fmt.Sprintf("tcp://%s:%d", address, port)
+				}
 				config := config.ClientConfig{
-					ScreenWidth:        1080,
-					ScreenHeight:       720,
-					ServerWebsocketURL: url,
+					ScreenWidth:  1080,
+					ScreenHeight: 720,
+					ServerURL:    url,
+					Codec:        clientCodec,
 				}
 
 				app := client.NewApp(&config)
@@ -99,6 +301,8 @@ func main() {
 		clientCmd.Flags().IntVarP(&port, "port", "p", 8080, "Port of the server")
 		clientCmd.Flags().StringVarP(&address, "address", "a", "localhost", "Address of the server")
 		clientCmd.Flags().BoolVarP(&secure, "secure", "s", false, "Whether to use WSS")
+		clientCmd.Flags().BoolVar(&tcp, "tcp", false, "Whether to connect over raw TCP instead of a websocket")
+		clientCmd.Flags().StringVar(&clientCodec, "codec", "msgpack", "Codec to write the messages with, msgpack or json")
 
 		rootCmd.AddCommand(clientCmd)
 	}
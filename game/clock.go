@@ -0,0 +1,18 @@
+package game
+
+import "time"
+
+// Source of time driving the simulation, so that it can be replaced when
+// replaying a game.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (self systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Reads the time of the machine.
+var SystemClock Clock = systemClock{}
@@ -8,6 +8,9 @@ import (
 
 type BulletData struct {
 	FiredBy types.PlayerId
+
+	// How many ticks behind the server the shooter saw the world.
+	RewindTicks uint64
 }
 
 var Bullet = donburi.NewComponentType[BulletData]()
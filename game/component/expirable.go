@@ -1,17 +1,17 @@
 package component
 
 import (
-	"time"
-
 	"github.com/yohamta/donburi"
 )
 
+// Entities with this component are removed once the simulation reaches the
+// given tick.
 type ExpirableData struct {
-	ExpiresWhen time.Time
+	ExpiresAt uint64
 }
 
-func NewExpirable(duration time.Duration) ExpirableData {
-	return ExpirableData{ExpiresWhen: time.Now().Add(duration)}
+func NewExpirable(expiresAt uint64) ExpirableData {
+	return ExpirableData{ExpiresAt: expiresAt}
 }
 
 var Expirable = donburi.NewComponentType[ExpirableData]()
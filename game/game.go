@@ -4,7 +4,8 @@ import (
 	"astro-blasters/assets"
 	"astro-blasters/game/component"
 	"astro-blasters/game/types"
-	"log"
+	"errors"
+	"fmt"
 	"math"
 	"math/rand"
 	"time"
@@ -16,37 +17,114 @@ import (
 )
 
 const (
-	PlayerDamagePerHit  = 5
+	PlayerDamagePerHit = 5
+
+	// Distances travelled in a single tick.
 	PlayerMovementSpeed = 5
 	PlayerRotationSpeed = 5
-
-	BulletSpeed = 20
+	BulletSpeed         = 20
 
 	MapWidth  = 4096
 	MapHeight = 4096
 
 	ShipWidth  = 32
 	ShipHeight = 32
+
+	// The fixed timestep of the simulation.
+	TickDuration = 16 * time.Millisecond // ~60 FPS
+
+	// How many ticks are run at most to catch up when the simulation fell
+	// behind the clock, the rest of the delay is dropped.
+	MaxCatchUpTicks = 5
+
+	// Hard limit on how far back bullet collisions can be rewound to
+	// compensate for the latency of the shooter.
+	MaxRewindTicks = 30 // ~500ms
+
+	// How long a bullet flies before it expires.
+	BulletLifetime = time.Second
 )
 
+var ErrUnknownPlayer = errors.New("Unknown player")
+var ErrUnknownMove = errors.New("Unknown move")
+
 type GameSimulation struct {
 	ECS             *ecs.ECS
+	Tick            uint64
 	OnBulletCollide func(player *donburi.Entry, bullet *donburi.Entry)
 	OnBulletFire    func(player *donburi.Entry)
+
+	clock       Clock
+	lastAdvance time.Time
+	// Time elapsed on the clock that has not been simulated yet.
+	accumulator time.Duration
+	random      *rand.Rand
+
+	history     *PositionHistory
+	rewindTicks uint64
+	// How many ticks behind the server each player sees the world.
+	viewLag map[types.PlayerId]uint64
 }
 
-func NewGameSimulation() *GameSimulation {
+// Simulations created with the same seed and fed the same moves at the same
+// ticks end up in the same state.
+func NewGameSimulation(clock Clock, seed int64) *GameSimulation {
 	return &GameSimulation{
 		ECS:             ecs.NewECS(donburi.NewWorld()),
 		OnBulletCollide: func(player *donburi.Entry, bullet *donburi.Entry) {},
 		OnBulletFire:    func(player *donburi.Entry) {},
+		clock:           clock,
+		random:          rand.New(rand.NewSource(seed)),
+		history:         NewPositionHistory(MaxRewindTicks + 1),
+		viewLag:         make(map[types.PlayerId]uint64),
+	}
+}
+
+// Sets how far back collisions may be rewound, capped at MaxRewindTicks.
+func (self *GameSimulation) SetRewindWindow(window time.Duration) {
+	self.rewindTicks = min(DurationToTicks(window), MaxRewindTicks)
+}
+
+// Runs as many ticks as fit in the time elapsed on the clock since the last
+// call, whatever the rate at which it is called. Returns the number of ticks.
+func (self *GameSimulation) Advance() int {
+	now := self.clock.Now()
+	if !self.lastAdvance.IsZero() {
+		self.accumulator += now.Sub(self.lastAdvance)
+	}
+	self.lastAdvance = now
+
+	ticks := 0
+	for self.accumulator >= TickDuration && ticks < MaxCatchUpTicks {
+		self.Update()
+		self.accumulator -= TickDuration
+		ticks += 1
+	}
+
+	if self.accumulator >= TickDuration {
+		self.accumulator = 0
+	}
+	return ticks
+}
+
+// Registers the tick of the world that the player was seeing when it sent
+// its last move, the bullets it fires are checked against that tick.
+func (self *GameSimulation) RegisterPlayerView(playerId types.PlayerId, tick uint64) {
+	if tick == 0 || tick > self.Tick {
+		self.viewLag[playerId] = 0
+		return
 	}
+	self.viewLag[playerId] = min(self.Tick-tick, self.rewindTicks)
 }
 
+// Runs a single tick of the simulation.
 func (self *GameSimulation) Update() {
+	self.Tick += 1
+	self.recordHistory()
+
 	for expirable := range donburi.NewQuery(filter.Contains(component.Expirable)).Iter(self.ECS.World) {
 		expirableData := component.Expirable.GetValue(expirable)
-		if time.Now().After(expirableData.ExpiresWhen) {
+		if self.Tick >= expirableData.ExpiresAt {
 			self.ECS.World.Remove(expirable.Entity())
 		}
 	}
@@ -58,11 +136,19 @@ func (self *GameSimulation) Update() {
 		didCollide := false
 		var collidedPlayer *donburi.Entry
 
+		// Check against where the players were when the shooter fired.
+		rewindTick := self.Tick - min(component.Bullet.Get(bullet).RewindTicks, self.Tick)
+
 		for player := range donburi.NewQuery(filter.Contains(component.Player)).Iter(self.ECS.World) {
 			playerData := component.Player.Get(player)
 			isDamageable := playerData.IsAlive && playerData.IsConnected
 
-			if isDamageable && component.Position.Get(player).IntersectsWith(&futureBulletPosition, 20) {
+			playerPosition, ok := self.history.Lookup(playerData.Id, rewindTick)
+			if !ok {
+				playerPosition = component.Position.GetValue(player)
+			}
+
+			if isDamageable && playerPosition.IntersectsWith(&futureBulletPosition, 20) {
 				didCollide = true
 				collidedPlayer = player
 			}
@@ -88,34 +174,54 @@ func (self *GameSimulation) Update() {
 			self.OnBulletFire(player)
 		}
 
-		futurePosition := component.Position.GetValue(player)
-		if playerData.IsMovingForward {
-			futurePosition.Forward(PlayerMovementSpeed)
-		}
+		self.MovePlayer(player)
+	}
+}
 
-		if playerData.IsRotatingClockwise {
-			futurePosition.Rotate(PlayerRotationSpeed)
-		}
+// Advances the position of the player by a single tick.
+func (self *GameSimulation) MovePlayer(player *donburi.Entry) {
+	playerData := component.Player.Get(player)
 
-		if playerData.IsRotatingCounterClockwise {
-			futurePosition.Rotate(-PlayerRotationSpeed)
-		}
+	futurePosition := component.Position.GetValue(player)
+	if playerData.IsMovingForward {
+		futurePosition.Forward(PlayerMovementSpeed)
+	}
 
-		if futurePosition.X < ShipWidth || futurePosition.X > MapWidth-ShipWidth {
-			continue
-		}
-		if futurePosition.Y < ShipHeight || futurePosition.Y > MapHeight-ShipHeight {
-			continue
-		}
+	if playerData.IsRotatingClockwise {
+		futurePosition.Rotate(PlayerRotationSpeed)
+	}
 
-		component.Position.SetValue(player, futurePosition)
+	if playerData.IsRotatingCounterClockwise {
+		futurePosition.Rotate(-PlayerRotationSpeed)
 	}
+
+	if futurePosition.X < ShipWidth || futurePosition.X > MapWidth-ShipWidth {
+		return
+	}
+	if futurePosition.Y < ShipHeight || futurePosition.Y > MapHeight-ShipHeight {
+		return
+	}
+
+	component.Position.SetValue(player, futurePosition)
 }
 
-func (self *GameSimulation) UpdatePlayerHealth(playerId types.PlayerId, health float64) {
+func (self *GameSimulation) recordHistory() {
+	positions := make(map[types.PlayerId]component.PositionData)
+	for player := range donburi.NewQuery(filter.Contains(component.Player, component.Position)).Iter(self.ECS.World) {
+		positions[component.Player.Get(player).Id] = component.Position.GetValue(player)
+	}
+	self.history.Record(self.Tick, positions)
+}
+
+func (self *GameSimulation) UpdatePlayerHealth(playerId types.PlayerId, health float64) error {
 	player := self.FindCorrespondingPlayer(playerId)
+	if player == nil {
+		return fmt.Errorf("%w %d", ErrUnknownPlayer, playerId)
+	}
+
 	playerData := component.Player.Get(player)
 	playerData.Health = health
+	return nil
 }
 
 func (self *GameSimulation) RegisterPlayerDisconnection(player *donburi.Entry) {
@@ -123,9 +229,22 @@ func (self *GameSimulation) RegisterPlayerDisconnection(player *donburi.Entry) {
 	playerData.IsConnected = false
 }
 
+func (self *GameSimulation) RemovePlayer(player *donburi.Entry) {
+	delete(self.viewLag, component.Player.Get(player).Id)
+	self.ECS.World.Remove(player.Entity())
+}
+
+func (self *GameSimulation) RegisterPlayerReconnection(player *donburi.Entry) {
+	playerData := component.Player.Get(player)
+	playerData.IsConnected = true
+}
+
+// The killer is nil when nobody is credited, e.g. the shooter left the game.
 func (self *GameSimulation) RegisterPlayerDeath(victim, killer *donburi.Entry) {
-	killerData := component.Player.Get(killer)
-	killerData.Score += 10
+	if killer != nil {
+		killerData := component.Player.Get(killer)
+		killerData.Score += 10
+	}
 
 	victimData := component.Player.Get(victim)
 	victimData.Score /= 2
@@ -136,10 +255,10 @@ func (self *GameSimulation) RegisterPlayerDeath(victim, killer *donburi.Entry) {
 	victimData.IsAlive = false
 }
 
-func (self *GameSimulation) RegisterPlayerMove(playerId types.PlayerId, move types.PlayerMove) {
+func (self *GameSimulation) RegisterPlayerMove(playerId types.PlayerId, move types.PlayerMove) error {
 	player := self.FindCorrespondingPlayer(playerId)
 	if player == nil {
-		log.Fatal("Invalid player Id")
+		return fmt.Errorf("%w %d", ErrUnknownPlayer, playerId)
 	}
 
 	playerData := component.Player.Get(player)
@@ -163,7 +282,10 @@ func (self *GameSimulation) RegisterPlayerMove(playerId types.PlayerId, move typ
 		playerData.IsRotatingCounterClockwise = true
 	case types.PlayerStopRotateCounterClockwise:
 		playerData.IsRotatingCounterClockwise = false
+	default:
+		return fmt.Errorf("%w %d", ErrUnknownMove, move)
 	}
+	return nil
 }
 
 func (self *GameSimulation) RegisterPlayerFire(player *donburi.Entry) {
@@ -194,7 +316,8 @@ func (self *GameSimulation) FireBullet(player *donburi.Entry, bulletPosition com
 	component.Bullet.SetValue(
 		bullet,
 		component.BulletData{
-			FiredBy: playerData.Id,
+			FiredBy:     playerData.Id,
+			RewindTicks: self.viewLag[playerData.Id],
 		},
 	)
 	component.Position.SetValue(
@@ -203,7 +326,7 @@ func (self *GameSimulation) FireBullet(player *donburi.Entry, bulletPosition com
 	)
 	component.Expirable.SetValue(
 		bullet,
-		component.NewExpirable(time.Second),
+		component.NewExpirable(self.Tick+DurationToTicks(BulletLifetime)),
 	)
 	component.Sprite.SetValue(
 		bullet,
@@ -252,6 +375,10 @@ func (self *GameSimulation) FindCorrespondingPlayer(playerId types.PlayerId) *do
 }
 
 func (self *GameSimulation) spawnExplosion(position *component.PositionData) {
+	self.CreateExplosion(position, self.random.Intn(3))
+}
+
+func (self *GameSimulation) CreateExplosion(position *component.PositionData, count int) *donburi.Entry {
 	world := self.ECS.World
 	entity := world.Create(component.Position, component.Explosion, component.Animation, component.Expirable)
 	explosion := world.Entry(entity)
@@ -259,7 +386,7 @@ func (self *GameSimulation) spawnExplosion(position *component.PositionData) {
 	component.Explosion.SetValue(
 		explosion,
 		component.ExplosionData{
-			Count: rand.Intn(3),
+			Count: count,
 		},
 	)
 	component.Position.SetValue(
@@ -272,23 +399,30 @@ func (self *GameSimulation) spawnExplosion(position *component.PositionData) {
 	)
 	component.Expirable.SetValue(
 		explosion,
-		component.NewExpirable(2*time.Second),
+		component.NewExpirable(self.Tick+DurationToTicks(2*time.Second)),
 	)
+
+	return explosion
 }
 
-func GenerateRandomPlayerPosition() component.PositionData {
+func (self *GameSimulation) GenerateRandomPlayerPosition() component.PositionData {
 	return component.PositionData{
-		X:     generateRandomFloat(ShipWidth, 0.80*MapWidth),
-		Y:     generateRandomFloat(ShipHeight, 0.80*MapHeight),
-		Angle: generateRandomFloat(0, 1),
+		X:     self.generateRandomFloat(ShipWidth, 0.80*MapWidth),
+		Y:     self.generateRandomFloat(ShipHeight, 0.80*MapHeight),
+		Angle: self.generateRandomFloat(0, 1),
 	}
 }
 
+// Number of whole ticks in the duration.
+func DurationToTicks(duration time.Duration) uint64 {
+	return uint64(duration / TickDuration)
+}
+
 func getShipSprite(playerId types.PlayerId) *ebiten.Image {
 	i := int(playerId)
 	return assets.Ships.GetTile(assets.TileIndex{X: 1, Y: i % 5})
 }
 
-func generateRandomFloat(min, max float64) float64 {
-	return max*rand.Float64() + min
+func (self *GameSimulation) generateRandomFloat(min, max float64) float64 {
+	return max*self.random.Float64() + min
 }
@@ -0,0 +1,144 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"astro-blasters/game/component"
+	"astro-blasters/game/types"
+
+	"github.com/yohamta/donburi"
+	"github.com/yohamta/donburi/filter"
+)
+
+// Only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (self *fakeClock) Now() time.Time {
+	return self.now
+}
+
+type loggedMove struct {
+	tick     uint64
+	playerId types.PlayerId
+	move     types.PlayerMove
+}
+
+// Two ships facing each other, close enough for their bullets to hit.
+var testInputLog = []loggedMove{
+	{1, 0, types.PlayerStartFireBullet},
+	{40, 1, types.PlayerStartFireBullet},
+	{100, 1, types.PlayerStartForward},
+	{110, 1, types.PlayerStopForward},
+	{150, 0, types.PlayerStartRotateClockwise},
+	{160, 0, types.PlayerStopRotateClockwise},
+	{250, 0, types.PlayerStopFireBullet},
+	{250, 1, types.PlayerStopFireBullet},
+}
+
+const testTicks = 300
+
+// Plays the input log, letting the ships respawn at random when destroyed.
+func replay(seed int64, inputLog []loggedMove) (*GameSimulation, int) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	simulation := NewGameSimulation(clock, seed)
+	simulation.SetRewindWindow(100 * time.Millisecond)
+
+	hits := 0
+	simulation.OnBulletFire = func(player *donburi.Entry) {
+		if simulation.Tick%10 == 0 {
+			simulation.RegisterPlayerFire(player)
+		}
+	}
+	simulation.OnBulletCollide = func(player *donburi.Entry, bullet *donburi.Entry) {
+		hits += 1
+		playerData := component.Player.Get(player)
+		playerData.Health -= 50
+		if playerData.Health <= 0 {
+			simulation.RegisterPlayerDeath(player, simulation.FindCorrespondingPlayer(component.Bullet.Get(bullet).FiredBy))
+			simulation.RespawnPlayer(player, simulation.GenerateRandomPlayerPosition())
+		}
+	}
+
+	simulation.CreatePlayer(0, &component.PositionData{X: 1000, Y: 1200}, "first", true)
+	simulation.CreatePlayer(1, &component.PositionData{X: 1000, Y: 1000, Angle: 3}, "second", true)
+
+	for simulation.Tick < testTicks {
+		for _, logged := range inputLog {
+			if logged.tick == simulation.Tick+1 {
+				simulation.RegisterPlayerView(logged.playerId, simulation.Tick)
+				simulation.RegisterPlayerMove(logged.playerId, logged.move)
+			}
+		}
+
+		clock.now = clock.now.Add(TickDuration)
+		simulation.Advance()
+	}
+	return simulation, hits
+}
+
+// Describes every entity of the world, in a stable order.
+func describeWorld(simulation *GameSimulation) []string {
+	var entities []string
+	query := donburi.NewQuery(filter.Contains(component.Position))
+	for entry := range query.Iter(simulation.ECS.World) {
+		description := fmt.Sprintf("%+v", component.Position.GetValue(entry))
+		if entry.HasComponent(component.Player) {
+			description += fmt.Sprintf(" player %+v", component.Player.GetValue(entry))
+		}
+		if entry.HasComponent(component.Bullet) {
+			description += fmt.Sprintf(" bullet %+v", component.Bullet.GetValue(entry))
+		}
+		if entry.HasComponent(component.Explosion) {
+			description += fmt.Sprintf(" explosion %+v", component.Explosion.GetValue(entry))
+		}
+		if entry.HasComponent(component.Expirable) {
+			description += fmt.Sprintf(" expires %+v", component.Expirable.GetValue(entry))
+		}
+		entities = append(entities, description)
+	}
+	slices.Sort(entities)
+	return entities
+}
+
+func TestSameInputLogSameWorld(t *testing.T) {
+	first, hits := replay(42, testInputLog)
+	second, _ := replay(42, testInputLog)
+
+	if first.Tick != testTicks || second.Tick != testTicks {
+		t.Fatalf("Got the ticks %d and %d, expected %d", first.Tick, second.Tick, testTicks)
+	}
+	if hits == 0 {
+		t.Fatal("No bullet hit, the log does not exercise the collisions")
+	}
+
+	firstWorld, secondWorld := describeWorld(first), describeWorld(second)
+	if !slices.Equal(firstWorld, secondWorld) {
+		t.Errorf("The worlds differ:\n%v\n%v", firstWorld, secondWorld)
+	}
+}
+
+func TestOtherSeedOtherWorld(t *testing.T) {
+	first, _ := replay(1, testInputLog)
+	second, _ := replay(2, testInputLog)
+
+	if slices.Equal(describeWorld(first), describeWorld(second)) {
+		t.Error("The seed did not change the world")
+	}
+}
+
+func TestEventsAboutUnknownPlayers(t *testing.T) {
+	simulation := NewGameSimulation(&fakeClock{now: time.Unix(0, 0)}, 1)
+
+	if err := simulation.UpdatePlayerHealth(7, 50); !errors.Is(err, ErrUnknownPlayer) {
+		t.Errorf("Updating the health got %v, expected %v", err, ErrUnknownPlayer)
+	}
+	if err := simulation.RegisterPlayerMove(7, types.PlayerStartForward); !errors.Is(err, ErrUnknownPlayer) {
+		t.Errorf("Moving got %v, expected %v", err, ErrUnknownPlayer)
+	}
+}
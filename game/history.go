@@ -0,0 +1,41 @@
+package game
+
+import (
+	"astro-blasters/game/component"
+	"astro-blasters/game/types"
+)
+
+type historyEntry struct {
+	tick      uint64
+	positions map[types.PlayerId]component.PositionData
+}
+
+// Ring buffer of the positions of every player over the last few ticks.
+type PositionHistory struct {
+	entries []historyEntry
+}
+
+func NewPositionHistory(capacity int) *PositionHistory {
+	return &PositionHistory{
+		entries: make([]historyEntry, capacity),
+	}
+}
+
+func (self *PositionHistory) Record(tick uint64, positions map[types.PlayerId]component.PositionData) {
+	self.entries[tick%uint64(len(self.entries))] = historyEntry{
+		tick:      tick,
+		positions: positions,
+	}
+}
+
+// Returns the position of the player at the given tick if it is still in the
+// history.
+func (self *PositionHistory) Lookup(playerId types.PlayerId, tick uint64) (component.PositionData, bool) {
+	entry := self.entries[tick%uint64(len(self.entries))]
+	if entry.tick != tick || entry.positions == nil {
+		return component.PositionData{}, false
+	}
+
+	position, ok := entry.positions[playerId]
+	return position, ok
+}
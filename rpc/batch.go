@@ -0,0 +1,93 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Several messages sent in a single frame, so that the events of a tick cost
+// one write instead of one each. The router unpacks it and dispatches the
+// messages in the order they were written.
+type Batch struct {
+	Messages []BaseMessage
+}
+
+// Returned for a batch inside a batch, which is dropped.
+var ErrNestedBatch = errors.New("Batches can not be nested")
+
+// Writes the messages as a single Batch message.
+func WriteBatch(ctx context.Context, transport Transport, messages []BaseMessage) error {
+	codec := transport.Codec()
+
+	encoded := make([]BaseMessage, len(messages))
+	payloadsSize := 0
+	for i, message := range messages {
+		payload, err := codec.EncodePayload(message.value)
+		if err != nil {
+			return err
+		}
+		encoded[i] = BaseMessage{MessageType: message.MessageType, Payload: payload}
+		payloadsSize += len(payload)
+	}
+
+	frame, err := codec.EncodeBatch(encoded)
+	if err != nil {
+		return err
+	}
+	if err := transport.WriteFrame(ctx, frame); err != nil {
+		return err
+	}
+
+	// The envelopes are accounted to the batch, the payloads to their own
+	// message types.
+	if observer := loadObserver(); observer != nil {
+		for _, message := range encoded {
+			observer.MessageSent(message.MessageType, len(message.Payload))
+		}
+		observer.MessageSent(TypeOf[Batch](), len(frame)-payloadsSize)
+	}
+	return nil
+}
+
+// Returns the messages of a Batch message.
+func UnpackBatch(message BaseMessage) ([]BaseMessage, error) {
+	if message.MessageType != TypeOf[Batch]() {
+		return nil, fmt.Errorf("%w %s, expected %s", ErrUnexpectedMessage, registry.nameOf(message.MessageType), registry.nameOf(TypeOf[Batch]()))
+	}
+
+	if batch, ok := message.value.(Batch); ok {
+		return batch.Messages, nil
+	}
+
+	codec := message.codec
+	if codec == nil {
+		codec = MsgpackCodec
+	}
+	messages, err := codec.DecodeBatch(message.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+	return messages, nil
+}
+
+// Dispatches every message of the batch, even when some of them fail. A
+// batch is not unpacked any further.
+func (self *Router) dispatchBatch(message BaseMessage) error {
+	messages, err := UnpackBatch(message)
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, message := range messages {
+		if message.MessageType == TypeOf[Batch]() {
+			errs = append(errs, ErrNestedBatch)
+			continue
+		}
+		if err := self.dispatch(message); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,299 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Turns messages into bytes and back. Every codec puts the type of the
+// message and its payload in an envelope of its own.
+type Codec interface {
+	Name() string
+	Encode(messageType MessageType, payload any) ([]byte, error)
+	// Splits the data into the type of the message and its encoded payload.
+	Decode(data []byte, message *BaseMessage) error
+	EncodePayload(payload any) ([]byte, error)
+	DecodePayload(payload []byte, out any) error
+	// Puts the messages, whose payloads are already encoded, in a single
+	// Batch message, each in its own envelope.
+	EncodeBatch(messages []BaseMessage) ([]byte, error)
+	DecodeBatch(payload []byte) ([]BaseMessage, error)
+}
+
+var (
+	MsgpackCodec Codec = msgpackCodec{}
+	// Much larger but readable in captured traffic, meant for debugging.
+	JSONCodec Codec = jsonCodec{}
+	// The msgpack envelope of protocol 1, which named the type of the message
+	// instead of giving its id. It is never negotiated, the server answers in
+	// it the clients that wrote in it.
+	LegacyCodec Codec = legacyCodec{}
+)
+
+var codecs = map[string]Codec{
+	MsgpackCodec.Name(): MsgpackCodec,
+	JSONCodec.Name():    JSONCodec,
+}
+
+func CodecByName(name string) (Codec, error) {
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown codec %s", name)
+	}
+	return codec, nil
+}
+
+// Names of the supported codecs, starting with the preferred one or msgpack
+// when there is none.
+func CodecNames(preferred string) []string {
+	if _, ok := codecs[preferred]; !ok {
+		preferred = MsgpackCodec.Name()
+	}
+
+	names := []string{}
+	for name := range codecs {
+		if name != preferred {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return append([]string{preferred}, names...)
+}
+
+// Picks the codec for a peer offering the given ones. The preferred codec of
+// this side wins when the peer supports it, otherwise the first one offered
+// that is known here. Peers that offer none are spoken to in msgpack.
+func NegotiateCodec(preferred string, offered []string) Codec {
+	for _, name := range offered {
+		if name == preferred {
+			return codecs[name]
+		}
+	}
+	for _, name := range offered {
+		if codec, ok := codecs[name]; ok {
+			return codec
+		}
+	}
+	return MsgpackCodec
+}
+
+// Tells which codec encoded the data. Messages are read whatever the codec
+// that was negotiated, so both sides can switch without coordination.
+func detectCodec(data []byte) Codec {
+	if len(data) > 0 && data[0] == '{' {
+		return JSONCodec
+	}
+	return MsgpackCodec
+}
+
+type msgpackCodec struct{}
+
+type msgpackEnvelope struct {
+	MessageType MessageType
+	Payload     msgpack.RawMessage
+}
+
+func (self msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (self msgpackCodec) Encode(messageType MessageType, payload any) ([]byte, error) {
+	encodedPayload, err := msgpack.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(msgpackEnvelope{MessageType: messageType, Payload: encodedPayload})
+}
+
+func (self msgpackCodec) Decode(data []byte, message *BaseMessage) error {
+	// The payload is copied while decoding, so the data can be reused.
+	var envelope msgpackEnvelope
+	if err := msgpack.Unmarshal(data, &envelope); err != nil {
+		if legacyErr := LegacyCodec.Decode(data, message); legacyErr == nil {
+			return nil
+		}
+		return err
+	}
+
+	*message = BaseMessage{MessageType: envelope.MessageType, Payload: envelope.Payload, codec: self}
+	return nil
+}
+
+func (self msgpackCodec) EncodePayload(payload any) ([]byte, error) {
+	return msgpack.Marshal(payload)
+}
+
+func (self msgpackCodec) DecodePayload(payload []byte, out any) error {
+	return msgpack.Unmarshal(payload, out)
+}
+
+func (self msgpackCodec) EncodeBatch(messages []BaseMessage) ([]byte, error) {
+	envelopes := make([]msgpackEnvelope, len(messages))
+	for i, message := range messages {
+		envelopes[i] = msgpackEnvelope{MessageType: message.MessageType, Payload: message.Payload}
+	}
+	return self.Encode(TypeOf[Batch](), envelopes)
+}
+
+func (self msgpackCodec) DecodeBatch(payload []byte) ([]BaseMessage, error) {
+	var envelopes []msgpackEnvelope
+	if err := msgpack.Unmarshal(payload, &envelopes); err != nil {
+		return nil, err
+	}
+
+	messages := make([]BaseMessage, len(envelopes))
+	for i, envelope := range envelopes {
+		messages[i] = BaseMessage{MessageType: envelope.MessageType, Payload: envelope.Payload, codec: self}
+	}
+	return messages, nil
+}
+
+type legacyCodec struct{}
+
+type legacyEnvelope struct {
+	MessageType string
+	Payload     msgpack.RawMessage
+}
+
+var errLegacyBatch = errors.New("Protocol 1 has no batches")
+
+func (self legacyCodec) Name() string {
+	return "msgpack-v1"
+}
+
+func (self legacyCodec) Encode(messageType MessageType, payload any) ([]byte, error) {
+	encodedPayload, err := msgpack.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(legacyEnvelope{MessageType: registry.nameOf(messageType), Payload: encodedPayload})
+}
+
+func (self legacyCodec) Decode(data []byte, message *BaseMessage) error {
+	var envelope legacyEnvelope
+	if err := msgpack.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+
+	id, ok := registry.names[envelope.MessageType]
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnknownMessage, envelope.MessageType)
+	}
+	*message = BaseMessage{MessageType: id, Payload: envelope.Payload, codec: self}
+	return nil
+}
+
+func (self legacyCodec) EncodePayload(payload any) ([]byte, error) {
+	return msgpack.Marshal(payload)
+}
+
+func (self legacyCodec) DecodePayload(payload []byte, out any) error {
+	return msgpack.Unmarshal(payload, out)
+}
+
+func (self legacyCodec) EncodeBatch(messages []BaseMessage) ([]byte, error) {
+	return nil, errLegacyBatch
+}
+
+func (self legacyCodec) DecodeBatch(payload []byte) ([]BaseMessage, error) {
+	return nil, errLegacyBatch
+}
+
+type jsonCodec struct{}
+
+type jsonEnvelope struct {
+	MessageType MessageType
+	// Only there for the humans reading the traffic.
+	Name    string `json:",omitempty"`
+	Payload json.RawMessage
+}
+
+func (self jsonCodec) Name() string {
+	return "json"
+}
+
+func (self jsonCodec) Encode(messageType MessageType, payload any) ([]byte, error) {
+	encodedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonEnvelope{
+		MessageType: messageType,
+		Name:        registry.nameOf(messageType),
+		Payload:     encodedPayload,
+	})
+}
+
+func (self jsonCodec) Decode(data []byte, message *BaseMessage) error {
+	var envelope jsonEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+
+	*message = BaseMessage{MessageType: envelope.MessageType, Payload: envelope.Payload, codec: self}
+	return nil
+}
+
+func (self jsonCodec) EncodePayload(payload any) ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (self jsonCodec) DecodePayload(payload []byte, out any) error {
+	return json.Unmarshal(payload, out)
+}
+
+func (self jsonCodec) EncodeBatch(messages []BaseMessage) ([]byte, error) {
+	envelopes := make([]jsonEnvelope, len(messages))
+	for i, message := range messages {
+		envelopes[i] = jsonEnvelope{
+			MessageType: message.MessageType,
+			Name:        registry.nameOf(message.MessageType),
+			Payload:     message.Payload,
+		}
+	}
+	return self.Encode(TypeOf[Batch](), envelopes)
+}
+
+func (self jsonCodec) DecodeBatch(payload []byte) ([]BaseMessage, error) {
+	var envelopes []jsonEnvelope
+	if err := json.Unmarshal(payload, &envelopes); err != nil {
+		return nil, err
+	}
+
+	messages := make([]BaseMessage, len(envelopes))
+	for i, envelope := range envelopes {
+		messages[i] = BaseMessage{MessageType: envelope.MessageType, Payload: envelope.Payload, codec: self}
+	}
+	return messages, nil
+}
+
+// Embedded in the transports to remember the codec their messages are
+// written with.
+type codecSelection struct {
+	mutex sync.Mutex
+	codec Codec
+}
+
+// Msgpack until another codec is negotiated.
+func (self *codecSelection) Codec() Codec {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.codec == nil {
+		return MsgpackCodec
+	}
+	return self.codec
+}
+
+func (self *codecSelection) SetCodec(codec Codec) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.codec = codec
+}
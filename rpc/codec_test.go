@@ -0,0 +1,175 @@
+package rpc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type testMessage struct {
+	Name   string
+	Count  int
+	Values []float64
+}
+
+func init() {
+	Register[testMessage](registry, 1000)
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	sent := testMessage{Name: "ship", Count: 3, Values: []float64{1.5, -2}}
+
+	for _, codec := range []Codec{MsgpackCodec, JSONCodec} {
+		data, err := codec.Encode(TypeOf[testMessage](), sent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var message BaseMessage
+		if err := detectCodec(data).Decode(data, &message); err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		if message.Codec() != codec {
+			t.Errorf("%s: detected as %s", codec.Name(), message.Codec().Name())
+		}
+
+		var received testMessage
+		if err := DecodeExpectedMessage(message, &received); err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		if !reflect.DeepEqual(received, sent) {
+			t.Errorf("%s: got %+v, expected %+v", codec.Name(), received, sent)
+		}
+	}
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	sent := []testMessage{{Name: "first"}, {Name: "second", Count: 2}}
+
+	for _, codec := range []Codec{MsgpackCodec, JSONCodec} {
+		encoded := make([]BaseMessage, len(sent))
+		for i, message := range sent {
+			payload, err := codec.EncodePayload(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded[i] = BaseMessage{MessageType: TypeOf[testMessage](), Payload: payload}
+		}
+
+		data, err := codec.EncodeBatch(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var message BaseMessage
+		if err := codec.Decode(data, &message); err != nil {
+			t.Fatal(err)
+		}
+		messages, err := UnpackBatch(message)
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+
+		if len(messages) != len(sent) {
+			t.Fatalf("%s: got %d messages, expected %d", codec.Name(), len(messages), len(sent))
+		}
+		for i, message := range messages {
+			var received testMessage
+			if err := DecodeExpectedMessage(message, &received); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(received, sent[i]) {
+				t.Errorf("%s: message %d is %+v, expected %+v", codec.Name(), i, received, sent[i])
+			}
+		}
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	tests := []struct {
+		preferred string
+		offered   []string
+		expected  Codec
+	}{
+		{"json", []string{"msgpack", "json"}, JSONCodec},
+		{"msgpack", []string{"json", "msgpack"}, MsgpackCodec},
+		// The first known codec offered when the preferred one is not.
+		{"json", []string{"msgpack"}, MsgpackCodec},
+		{"", []string{"json", "msgpack"}, JSONCodec},
+		{"msgpack", []string{"cbor", "json"}, JSONCodec},
+		// Older clients offer nothing and speak msgpack.
+		{"json", nil, MsgpackCodec},
+		{"json", []string{"cbor"}, MsgpackCodec},
+	}
+
+	for _, test := range tests {
+		if codec := NegotiateCodec(test.preferred, test.offered); codec != test.expected {
+			t.Errorf("NegotiateCodec(%q, %v) = %s, expected %s", test.preferred, test.offered, codec.Name(), test.expected.Name())
+		}
+	}
+}
+
+func TestCodecNames(t *testing.T) {
+	if names := CodecNames("json"); !reflect.DeepEqual(names, []string{"json", "msgpack"}) {
+		t.Errorf("Got %v, expected json first", names)
+	}
+	if names := CodecNames("cbor"); !reflect.DeepEqual(names, []string{"msgpack", "json"}) {
+		t.Errorf("Got %v, expected msgpack first for an unknown preference", names)
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	if _, err := CodecByName("cbor"); err == nil {
+		t.Error("Got a codec for an unknown name")
+	}
+	if codec, err := CodecByName("json"); err != nil || codec != JSONCodec {
+		t.Errorf("Got %v and %v, expected the json codec", codec, err)
+	}
+}
+
+func TestLegacyEnvelopeIsDecoded(t *testing.T) {
+	data, err := msgpack.Marshal(legacyEnvelope{MessageType: "Batch", Payload: msgpack.RawMessage{0x90}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var message BaseMessage
+	if err := detectCodec(data).Decode(data, &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.MessageType != TypeOf[Batch]() {
+		t.Errorf("Got the type %s, expected Batch", NameOf(message.MessageType))
+	}
+	if message.Codec() != LegacyCodec {
+		t.Errorf("Got the codec %v, expected the legacy one", message.Codec())
+	}
+}
+
+func TestLegacyEnvelopeWithUnknownName(t *testing.T) {
+	data, err := msgpack.Marshal(legacyEnvelope{MessageType: "NoSuchMessage"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var message BaseMessage
+	err = LegacyCodec.Decode(data, &message)
+	if !errors.Is(err, ErrUnknownMessage) {
+		t.Errorf("Got %v, expected %v", err, ErrUnknownMessage)
+	}
+}
+
+func TestLegacyCodecWritesTheName(t *testing.T) {
+	data, err := LegacyCodec.Encode(TypeOf[Batch](), []int{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var envelope legacyEnvelope
+	if err := msgpack.Unmarshal(data, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.MessageType != "Batch" {
+		t.Errorf("Got the name %q, expected Batch", envelope.MessageType)
+	}
+}
@@ -0,0 +1,7 @@
+package rpc
+
+// The messages of the protocol itself, the ones of the game are registered by
+// their own package. The same rules apply to the ids.
+func init() {
+	Register[Batch](registry, 60)
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Compact identifier of a message on the wire. Unlike the name of its type,
+// it does not change when the type is renamed.
+type MessageType uint16
+
+// Returned when a message carries an id that no type is registered with.
+var ErrUnknownMessage = errors.New("Unknown message")
+
+// Maps the message types to the ids they are sent with.
+type Registry struct {
+	ids   map[reflect.Type]MessageType
+	types map[MessageType]reflect.Type
+	// Protocol 1 sent the name of the type instead of its id.
+	names map[string]MessageType
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		ids:   make(map[reflect.Type]MessageType),
+		types: make(map[MessageType]reflect.Type),
+		names: make(map[string]MessageType),
+	}
+}
+
+// The registry used by the routers and codecs, which the packages defining
+// messages fill in when initialized.
+var registry = NewRegistry()
+
+func DefaultRegistry() *Registry {
+	return registry
+}
+
+// Associates the message type with the id. Panics when either of them is
+// already taken, as both sides would not agree on the protocol anymore.
+func Register[Message any](registry *Registry, id MessageType) {
+	messageType := reflect.TypeFor[Message]()
+
+	if existing, ok := registry.ids[messageType]; ok {
+		panic(fmt.Sprintf("Message %s is already registered with the id %d", messageType.Name(), existing))
+	}
+	if existing, ok := registry.types[id]; ok {
+		panic(fmt.Sprintf("Message id %d is already taken by %s", id, existing.Name()))
+	}
+
+	registry.ids[messageType] = id
+	registry.types[id] = messageType
+	registry.names[messageType.Name()] = id
+}
+
+// Returns the id the message type is sent with. Panics when it is not
+// registered.
+func TypeOf[Message any]() MessageType {
+	return registry.idOf(reflect.TypeFor[Message]())
+}
+
+// Name of the type registered with the id, or the id itself when unknown.
+func NameOf(messageType MessageType) string {
+	return registry.nameOf(messageType)
+}
+
+// Tells whether a type is registered with the id.
+func IsRegistered(messageType MessageType) bool {
+	_, ok := registry.types[messageType]
+	return ok
+}
+
+// Returns the id of the message type, panicking when it is not registered
+// since the message could never be decoded on the other side.
+func (self *Registry) idOf(messageType reflect.Type) MessageType {
+	id, ok := self.ids[messageType]
+	if !ok {
+		panic(fmt.Sprintf("Message %s is not registered", messageType.Name()))
+	}
+	return id
+}
+
+// Name of the type registered with the id, for error messages.
+func (self *Registry) nameOf(id MessageType) string {
+	if messageType, ok := self.types[id]; ok {
+		return messageType.Name()
+	}
+	return fmt.Sprintf("#%d", id)
+}
@@ -0,0 +1,75 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Returned when a known message arrived but nothing handles it here.
+var ErrUnexpectedMessage = errors.New("Unexpected message")
+
+// Decodes incoming messages and hands them to the handler of their type.
+type Router struct {
+	registry *Registry
+	handlers map[MessageType]func(message BaseMessage) error
+	filter   func(message BaseMessage) error
+}
+
+func NewRouter() *Router {
+	return &Router{
+		registry: registry,
+		handlers: make(map[MessageType]func(message BaseMessage) error),
+	}
+}
+
+// Registers the handler of a message type. Panics when the type is not
+// registered or already has a handler.
+func Handle[Message any](router *Router, handler func(message Message) error) {
+	id := router.registry.idOf(reflect.TypeFor[Message]())
+	if _, ok := router.handlers[id]; ok {
+		panic(fmt.Sprintf("Message %s already has a handler", router.registry.nameOf(id)))
+	}
+
+	router.handlers[id] = func(message BaseMessage) error {
+		var decoded Message
+		if err := DecodeExpectedMessage(message, &decoded); err != nil {
+			return err
+		}
+		return handler(decoded)
+	}
+}
+
+// Runs the function on every message before it is even looked up, including
+// the ones in a batch and the ones of unknown types. A message is dropped when
+// the function fails, and Dispatch returns the error.
+func (self *Router) Filter(filter func(message BaseMessage) error) {
+	self.filter = filter
+}
+
+// Runs the handler of the message and returns its error. The messages of a
+// batch are dispatched one after the other.
+func (self *Router) Dispatch(message BaseMessage) error {
+	if message.MessageType == TypeOf[Batch]() {
+		return self.dispatchBatch(message)
+	}
+	return self.dispatch(message)
+}
+
+func (self *Router) dispatch(message BaseMessage) error {
+	if self.filter != nil {
+		if err := self.filter(message); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := self.registry.types[message.MessageType]; !ok {
+		return fmt.Errorf("%w %d", ErrUnknownMessage, message.MessageType)
+	}
+
+	handler, ok := self.handlers[message.MessageType]
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnexpectedMessage, self.registry.nameOf(message.MessageType))
+	}
+	return handler(message)
+}
@@ -0,0 +1,69 @@
+package rpc
+
+import (
+	"errors"
+	"testing"
+)
+
+// Routes test messages, recording the ones handled and the ones filtered.
+func newTestRouter(handled *[]string, filtered *[]MessageType) *Router {
+	router := NewRouter()
+	Handle(router, func(message testMessage) error {
+		*handled = append(*handled, message.Name)
+		return nil
+	})
+	router.Filter(func(message BaseMessage) error {
+		*filtered = append(*filtered, message.MessageType)
+		return nil
+	})
+	return router
+}
+
+func TestFilterRunsBeforeLookup(t *testing.T) {
+	var handled []string
+	var filtered []MessageType
+	router := newTestRouter(&handled, &filtered)
+
+	if err := router.Dispatch(BaseMessage{MessageType: 999}); !errors.Is(err, ErrUnknownMessage) {
+		t.Errorf("Got %v, expected %v", err, ErrUnknownMessage)
+	}
+	if len(filtered) != 1 || filtered[0] != 999 {
+		t.Errorf("Got the filtered types %v, expected the unknown one", filtered)
+	}
+}
+
+func TestFilterDropsMessage(t *testing.T) {
+	router := NewRouter()
+	Handle(router, func(message testMessage) error {
+		t.Error("The filtered message was handled")
+		return nil
+	})
+	dropped := errors.New("dropped")
+	router.Filter(func(message BaseMessage) error {
+		return dropped
+	})
+
+	if err := router.Dispatch(NewBaseMessage(testMessage{})); !errors.Is(err, dropped) {
+		t.Errorf("Got %v, expected %v", err, dropped)
+	}
+}
+
+func TestNestedBatchRejected(t *testing.T) {
+	var handled []string
+	var filtered []MessageType
+	router := newTestRouter(&handled, &filtered)
+
+	nested := NewBaseMessage(Batch{Messages: []BaseMessage{NewBaseMessage(testMessage{Name: "nested"})}})
+	err := router.Dispatch(NewBaseMessage(Batch{Messages: []BaseMessage{
+		NewBaseMessage(testMessage{Name: "first"}),
+		nested,
+		NewBaseMessage(testMessage{Name: "last"}),
+	}}))
+
+	if !errors.Is(err, ErrNestedBatch) {
+		t.Errorf("Got %v, expected %v", err, ErrNestedBatch)
+	}
+	if len(handled) != 2 || handled[0] != "first" || handled[1] != "last" {
+		t.Errorf("Handled %v, expected the messages around the nested batch", handled)
+	}
+}
@@ -2,75 +2,178 @@ package rpc
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"io"
 	"reflect"
 	"sync"
-
-	"github.com/coder/websocket"
-	"github.com/vmihailenco/msgpack/v5"
+	"sync/atomic"
 )
 
 type BaseMessage struct {
-	MessageType string
-	Payload     msgpack.RawMessage
+	MessageType MessageType
+	// Still encoded with the codec of the message.
+	Payload []byte
+
+	codec Codec
+	// The message itself when it was created by NewBaseMessage, it is only
+	// encoded once the codec of the transport is known.
+	value any
+}
+
+// Returned when a message arrived but could not be decoded, the connection
+// itself is still usable.
+var ErrMalformedMessage = errors.New("Malformed message")
+
+// Returned when a message is larger than the maximum size, the connection is
+// closed since the rest of the message can not be skipped.
+var ErrMessageTooLarge = errors.New("Message too large")
+
+const DefaultMaxMessageSize = 1 << 20 // 1MiB
+
+var maxMessageSize atomic.Int64
+
+func init() {
+	maxMessageSize.Store(DefaultMaxMessageSize)
+}
+
+// Sets the size of the largest message that is accepted.
+func SetMaxMessageSize(size int64) {
+	maxMessageSize.Store(size)
+}
+
+// Told about every message written or read, to keep track of the traffic.
+// The sizes are in bytes as encoded on the wire.
+type Observer interface {
+	MessageSent(messageType MessageType, size int)
+	MessageReceived(messageType MessageType, size int)
 }
 
+var observer atomic.Pointer[Observer]
+
+// Sets the observer of the messages of every transport, none when nil.
+func SetObserver(newObserver Observer) {
+	if newObserver == nil {
+		observer.Store(nil)
+		return
+	}
+	observer.Store(&newObserver)
+}
+
+func loadObserver() Observer {
+	if loaded := observer.Load(); loaded != nil {
+		return *loaded
+	}
+	return nil
+}
+
+// Most messages fit in the pooled buffers, larger ones get a buffer of their
+// own which is not kept around.
+const pooledBufferSize = 4096
+
 var bufferPool = sync.Pool{
 	New: func() interface{} {
-		// Create a new buffer if one isn't available in the pool.
-		// This example uses a buffer with a size of 4096 bytes (4KB).
-		return make([]byte, 4096)
+		buffer := make([]byte, pooledBufferSize)
+		return &buffer
 	},
 }
 
+// The codec the message was decoded with, nil when it was created here.
+func (self BaseMessage) Codec() Codec {
+	return self.codec
+}
+
 func NewBaseMessage(message any) BaseMessage {
-	payload, err := msgpack.Marshal(message)
-	if err != nil {
-		log.Fatal(err)
-	}
-	encoded := BaseMessage{
-		MessageType: reflect.TypeOf(message).Name(),
-		Payload:     payload,
+	return BaseMessage{
+		MessageType: registry.idOf(reflect.TypeOf(message)),
+		value:       message,
 	}
-	return encoded
 }
 
-func WriteMessage(ctx context.Context, conn *websocket.Conn, message BaseMessage) error {
-	marshaled, err := msgpack.Marshal(message)
+func WriteMessage(ctx context.Context, transport Transport, message BaseMessage) error {
+	encoded, err := transport.Codec().Encode(message.MessageType, message.value)
 	if err != nil {
 		return err
 	}
-	return conn.Write(ctx, websocket.MessageBinary, marshaled)
+	if err := transport.WriteFrame(ctx, encoded); err != nil {
+		return err
+	}
+
+	if observer := loadObserver(); observer != nil {
+		observer.MessageSent(message.MessageType, len(encoded))
+	}
+	return nil
 }
 
-func ReceiveMessage(ctx context.Context, conn *websocket.Conn, message *BaseMessage) error {
-	buffer := bufferPool.Get().([]byte)
+func ReceiveMessage(ctx context.Context, transport Transport, message *BaseMessage) error {
+	buffer := bufferPool.Get().(*[]byte)
 	defer bufferPool.Put(buffer)
 
-	_, reader, err := conn.Reader(ctx)
+	data, err := transport.ReadFrame(ctx, (*buffer)[:0], maxMessageSize.Load())
 	if err != nil {
 		return err
 	}
 
-	n, err := reader.Read(buffer)
-	if err != nil {
-		return err
+	if err := detectCodec(data).Decode(data, message); err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformedMessage, err)
 	}
 
-	return msgpack.Unmarshal(buffer[:n], message)
+	if observer := loadObserver(); observer != nil {
+		observer.MessageReceived(message.MessageType, len(data))
+	}
+	return nil
 }
 
-func ReceiveExpectedMessage[ExpectedMessage any](ctx context.Context, conn *websocket.Conn, out *ExpectedMessage) error {
+// Reads the whole message into the buffer, growing it when needed.
+func readMessage(reader io.Reader, buffer []byte, limit int64) ([]byte, error) {
+	limited := io.LimitReader(reader, limit+1)
+	for {
+		if len(buffer) == cap(buffer) {
+			buffer = append(buffer, 0)[:len(buffer)]
+		}
+
+		n, err := limited.Read(buffer[len(buffer):cap(buffer)])
+		buffer = buffer[:len(buffer)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if int64(len(buffer)) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrMessageTooLarge, limit)
+	}
+	return buffer, nil
+}
+
+func ReceiveExpectedMessage[ExpectedMessage any](ctx context.Context, transport Transport, out *ExpectedMessage) error {
 	var baseMessage BaseMessage
-	if err := ReceiveMessage(ctx, conn, &baseMessage); err != nil {
+	if err := ReceiveMessage(ctx, transport, &baseMessage); err != nil {
 		return err
 	}
-	return msgpack.Unmarshal(baseMessage.Payload, out)
+	return DecodeExpectedMessage(baseMessage, out)
 }
 
+// Decodes the message, failing when it is not of the expected type.
 func DecodeExpectedMessage[ExpectedMessage any](message BaseMessage, out *ExpectedMessage) error {
-	if err := msgpack.Unmarshal(message.Payload, out); err != nil {
-		return err
+	expected := registry.idOf(reflect.TypeFor[ExpectedMessage]())
+	if message.MessageType != expected {
+		return fmt.Errorf("%w %s, expected %s", ErrUnexpectedMessage, registry.nameOf(message.MessageType), registry.nameOf(expected))
+	}
+
+	if value, ok := message.value.(ExpectedMessage); ok {
+		*out = value
+		return nil
+	}
+
+	codec := message.codec
+	if codec == nil {
+		codec = MsgpackCodec
+	}
+	if err := codec.DecodePayload(message.Payload, out); err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformedMessage, err)
 	}
 	return nil
 }
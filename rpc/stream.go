@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Frames the messages over a byte stream, each one prefixed by its length as
+// a big-endian uint32. Used for TCP and in-process pipes.
+type StreamTransport struct {
+	codecSelection
+	conn       net.Conn
+	writeMutex sync.Mutex
+	// Set once the stream can not be read anymore.
+	readErr error
+}
+
+func NewStreamTransport(conn net.Conn) *StreamTransport {
+	return &StreamTransport{conn: conn}
+}
+
+func DialTCP(ctx context.Context, address string) (*StreamTransport, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamTransport(conn), nil
+}
+
+// Returns both ends of an in-memory connection, to run a client and a server
+// in the same process.
+func NewPipe() (*StreamTransport, *StreamTransport) {
+	client, server := net.Pipe()
+	return NewStreamTransport(client), NewStreamTransport(server)
+}
+
+func (self *StreamTransport) RemoteAddr() string {
+	return self.conn.RemoteAddr().String()
+}
+
+func (self *StreamTransport) ReadFrame(ctx context.Context, buffer []byte, limit int64) ([]byte, error) {
+	if self.readErr != nil {
+		return nil, self.readErr
+	}
+	defer watchContext(ctx, self.conn.SetReadDeadline)()
+
+	var header [4]byte
+	if _, err := io.ReadFull(self.conn, header[:]); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	size := int64(binary.BigEndian.Uint32(header[:]))
+	if size > limit {
+		// The rest of the stream can not be trusted anymore.
+		self.readErr = fmt.Errorf("%w: %d bytes, the limit is %d", ErrMessageTooLarge, size, limit)
+		return nil, self.readErr
+	}
+
+	if int64(cap(buffer)) < size {
+		buffer = make([]byte, size)
+	}
+	buffer = buffer[:size]
+
+	if _, err := io.ReadFull(self.conn, buffer); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return buffer, nil
+}
+
+func (self *StreamTransport) WriteFrame(ctx context.Context, data []byte) error {
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+
+	defer watchContext(ctx, self.conn.SetWriteDeadline)()
+
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	_, err := self.conn.Write(frame)
+	return contextError(ctx, err)
+}
+
+func (self *StreamTransport) Close() error {
+	return self.conn.Close()
+}
+
+// Makes the blocking calls on the connection return once the context is done.
+// The returned function must be called when the call is over.
+func watchContext(ctx context.Context, setDeadline func(time.Time) error) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		setDeadline(deadline)
+	} else {
+		setDeadline(time.Time{})
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		setDeadline(time.Now())
+	})
+	return func() { stop() }
+}
+
+// Reports the cancellation of the context rather than the deadline it caused.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestReadMessageLimit(t *testing.T) {
+	tests := []struct {
+		size     int
+		limit    int64
+		tooLarge bool
+	}{
+		{0, 10, false},
+		{10, 10, false},
+		{11, 10, true},
+		// Larger than the pooled buffers, which have to grow.
+		{3 * pooledBufferSize, 3 * pooledBufferSize, false},
+		{3*pooledBufferSize + 1, 3 * pooledBufferSize, true},
+	}
+
+	for _, test := range tests {
+		data := bytes.Repeat([]byte{'x'}, test.size)
+		read, err := readMessage(bytes.NewReader(data), make([]byte, 0, 16), test.limit)
+		if test.tooLarge {
+			if !errors.Is(err, ErrMessageTooLarge) {
+				t.Errorf("Reading %d bytes with a limit of %d gave %v, expected %v", test.size, test.limit, err, ErrMessageTooLarge)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(read, data) {
+			t.Errorf("Reading %d bytes with a limit of %d gave %d bytes and %v", test.size, test.limit, len(read), err)
+		}
+	}
+}
+
+func TestStreamFrameOverLimit(t *testing.T) {
+	client, server := NewPipe()
+	defer client.Close()
+	defer server.Close()
+	ctx := context.Background()
+
+	go client.WriteFrame(ctx, bytes.Repeat([]byte{'x'}, 64))
+	if _, err := server.ReadFrame(ctx, nil, 32); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Got %v, expected %v", err, ErrMessageTooLarge)
+	}
+
+	// The rest of the oversized frame must not be read as the next one.
+	if _, err := server.ReadFrame(ctx, nil, 1024); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Got %v after an oversized frame, expected %v", err, ErrMessageTooLarge)
+	}
+
+	// The client can still be told why it is dropped.
+	go server.WriteFrame(ctx, []byte("bye"))
+	if read, err := client.ReadFrame(ctx, nil, 32); err != nil || string(read) != "bye" {
+		t.Errorf("Got %q and %v, expected the frame written after the oversized one", read, err)
+	}
+}
+
+func TestStreamFrameWithinLimit(t *testing.T) {
+	client, server := NewPipe()
+	defer client.Close()
+	defer server.Close()
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte{'x'}, 32)
+	go client.WriteFrame(ctx, data)
+	read, err := server.ReadFrame(ctx, nil, 32)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("Got %d bytes and %v, expected the 32 bytes written", len(read), err)
+	}
+}
+
+func TestReceiveMessageUsesMaxMessageSize(t *testing.T) {
+	SetMaxMessageSize(16)
+	t.Cleanup(func() { SetMaxMessageSize(DefaultMaxMessageSize) })
+
+	client, server := NewPipe()
+	defer client.Close()
+	ctx := context.Background()
+
+	go WriteMessage(ctx, client, NewBaseMessage(Batch{Messages: make([]BaseMessage, 16)}))
+	var message BaseMessage
+	if err := ReceiveMessage(ctx, server, &message); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Got %v, expected %v", err, ErrMessageTooLarge)
+	}
+}
@@ -0,0 +1,44 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// A connection carrying whole messages in both directions, whatever the
+// medium underneath.
+type Transport interface {
+	// Reads the next message into the buffer, growing it when needed. Fails
+	// with ErrMessageTooLarge past the limit, after which every read fails
+	// but writes still go through, to tell the other side before closing.
+	ReadFrame(ctx context.Context, buffer []byte, limit int64) ([]byte, error)
+	// Writes a whole message, safe to call from several goroutines.
+	WriteFrame(ctx context.Context, data []byte) error
+	Close() error
+	// Address of the other side, host:port for the connections accepted by
+	// the server.
+	RemoteAddr() string
+
+	// The codec the messages are written with. Messages read are decoded
+	// with whatever codec they were written in.
+	Codec() Codec
+	SetCodec(codec Codec)
+}
+
+// Connects to the server at the url, through a websocket for ws:// and
+// wss:// or a raw TCP connection for tcp://.
+func Dial(ctx context.Context, address string) (Transport, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsed.Scheme {
+	case "ws", "wss":
+		return DialWebsocket(ctx, address)
+	case "tcp":
+		return DialTCP(ctx, parsed.Host)
+	}
+	return nil, fmt.Errorf("Unsupported scheme %s", parsed.Scheme)
+}
@@ -0,0 +1,77 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/coder/websocket"
+)
+
+// Sends every message as a binary websocket message.
+type WebsocketTransport struct {
+	codecSelection
+	conn       *websocket.Conn
+	remoteAddr string
+	// Set once the connection can not be read anymore.
+	readErr error
+	// Whether to tell the other side that it sent a message too large when
+	// closing.
+	tooLarge atomic.Bool
+}
+
+func NewWebsocketTransport(conn *websocket.Conn, remoteAddr string) *WebsocketTransport {
+	return &WebsocketTransport{conn: conn, remoteAddr: remoteAddr}
+}
+
+func DialWebsocket(ctx context.Context, url string) (*WebsocketTransport, error) {
+	conn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewWebsocketTransport(conn, url), nil
+}
+
+func AcceptWebsocket(w http.ResponseWriter, r *http.Request) (*WebsocketTransport, error) {
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewWebsocketTransport(conn, r.RemoteAddr), nil
+}
+
+func (self *WebsocketTransport) ReadFrame(ctx context.Context, buffer []byte, limit int64) ([]byte, error) {
+	if self.readErr != nil {
+		return nil, self.readErr
+	}
+	// Leave the enforcement of the limit to us, for a clearer error.
+	self.conn.SetReadLimit(limit + 1)
+
+	_, reader, err := self.conn.Reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readMessage(reader, buffer, limit)
+	if errors.Is(err, ErrMessageTooLarge) {
+		self.readErr = err
+		self.tooLarge.Store(true)
+	}
+	return data, err
+}
+
+func (self *WebsocketTransport) WriteFrame(ctx context.Context, data []byte) error {
+	return self.conn.Write(ctx, websocket.MessageBinary, data)
+}
+
+func (self *WebsocketTransport) RemoteAddr() string {
+	return self.remoteAddr
+}
+
+func (self *WebsocketTransport) Close() error {
+	if self.tooLarge.Load() {
+		return self.conn.Close(websocket.StatusMessageTooBig, ErrMessageTooLarge.Error())
+	}
+	return self.conn.CloseNow()
+}
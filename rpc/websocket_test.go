@@ -0,0 +1,60 @@
+//go:build !js
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coder/websocket"
+)
+
+func TestWebsocketFrameOverLimit(t *testing.T) {
+	errs := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		transport, err := AcceptWebsocket(w, r)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer transport.Close()
+
+		_, err = transport.ReadFrame(r.Context(), nil, 32)
+		errs <- err
+		if err == nil {
+			return
+		}
+		if err := transport.WriteFrame(r.Context(), []byte("bye")); err != nil {
+			errs <- err
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client, err := DialWebsocket(ctx, "ws"+strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.WriteFrame(ctx, bytes.Repeat([]byte{'x'}, 64)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Got %v, expected %v", err, ErrMessageTooLarge)
+	}
+
+	// The client can still be told why it is dropped, before the server
+	// closes the connection with the status of the error.
+	if read, err := client.ReadFrame(ctx, nil, 1024); err != nil || string(read) != "bye" {
+		t.Errorf("Got %q and %v, expected the frame written after the oversized one", read, err)
+	}
+	if _, err := client.ReadFrame(ctx, nil, 1024); websocket.CloseStatus(err) != websocket.StatusMessageTooBig {
+		t.Errorf("Got %v, expected the connection closed with %v", err, websocket.StatusMessageTooBig)
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"astro-blasters/game/component"
+	"astro-blasters/game/types"
+	"astro-blasters/rpc"
+	"astro-blasters/server/messages"
+)
+
+// Largest request body accepted by the admin API.
+const maxAdminRequestSize = 1 << 16
+
+// A player as listed by the admin API.
+type PlayerInfo struct {
+	RoomCode      string
+	PlayerId      types.PlayerId
+	Name          string
+	Address       string
+	IsConnected   bool
+	RoundTripTime string
+	Jitter        string
+	Score         int
+	Health        float64
+}
+
+type kickRequest struct {
+	RoomCode string
+	PlayerId types.PlayerId
+	Reason   string
+}
+
+type banRequest struct {
+	// Either the address or the name of the player to ban.
+	Address string
+	Name    string
+	// How long the ban lasts, like "1h30m".
+	Duration string
+	Reason   string
+}
+
+type announceRequest struct {
+	Message string
+}
+
+// The JSON API that lets the operators of the server inspect and moderate
+// the rooms, served under /admin to the bearers of the admin token.
+func (self *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /players", self.adminListPlayers)
+	mux.HandleFunc("POST /kick", self.adminKick)
+	mux.HandleFunc("GET /bans", self.adminListBans)
+	mux.HandleFunc("POST /bans", self.adminBan)
+	mux.HandleFunc("POST /announce", self.adminAnnounce)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(self.config.AdminToken)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "Missing or invalid admin token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (self *Server) adminListPlayers(w http.ResponseWriter, r *http.Request) {
+	players := []PlayerInfo{}
+	for _, room := range self.rooms.All() {
+		players = append(players, room.Players()...)
+	}
+	writeAdminResponse(w, http.StatusOK, players)
+}
+
+func (self *Server) adminKick(w http.ResponseWriter, r *http.Request) {
+	var request kickRequest
+	if err := readAdminRequest(w, r, &request); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	room := self.rooms.Get(request.RoomCode)
+	if room == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("There is no room with the code %s", request.RoomCode))
+		return
+	}
+
+	message := "You were kicked by an operator"
+	if request.Reason != "" {
+		message += ": " + request.Reason
+	}
+	if !room.Kick(request.PlayerId, messages.Disconnected{Reason: messages.DisconnectKicked, Message: message}) {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("Player %d is not connected to the room %s", request.PlayerId, room.code))
+		return
+	}
+	writeAdminResponse(w, http.StatusOK, request)
+}
+
+func (self *Server) adminListBans(w http.ResponseWriter, r *http.Request) {
+	writeAdminResponse(w, http.StatusOK, self.bans.List())
+}
+
+// Bans the address or the name and kicks the players it matches.
+func (self *Server) adminBan(w http.ResponseWriter, r *http.Request) {
+	var request banRequest
+	if err := readAdminRequest(w, r, &request); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	duration, err := time.ParseDuration(request.Duration)
+	if err != nil || duration <= 0 {
+		writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("Invalid ban duration %q", request.Duration))
+		return
+	}
+
+	ban := Ban{
+		Address: request.Address,
+		Name:    request.Name,
+		Until:   time.Now().Add(duration),
+		Reason:  request.Reason,
+	}
+	if err := self.bans.Add(ban); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	disconnected := messages.Disconnected{
+		Reason:  messages.DisconnectBanned,
+		Message: fmt.Sprintf("You were banned for %s", duration),
+	}
+	if request.Reason != "" {
+		disconnected.Message += ": " + request.Reason
+	}
+
+	for _, room := range self.rooms.All() {
+		for _, player := range room.Players() {
+			matchesAddress := ban.Address != "" && banHost(player.Address) == banHost(ban.Address)
+			matchesName := ban.Name != "" && strings.EqualFold(player.Name, ban.Name)
+			if matchesAddress || matchesName {
+				room.Kick(player.PlayerId, disconnected)
+			}
+		}
+	}
+	writeAdminResponse(w, http.StatusOK, ban)
+}
+
+func (self *Server) adminAnnounce(w http.ResponseWriter, r *http.Request) {
+	var request announceRequest
+	if err := readAdminRequest(w, r, &request); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if request.Message == "" {
+		writeAdminError(w, http.StatusBadRequest, "The announcement is empty")
+		return
+	}
+
+	for _, room := range self.rooms.All() {
+		room.Announce(request.Message)
+	}
+	writeAdminResponse(w, http.StatusOK, request)
+}
+
+func readAdminRequest(w http.ResponseWriter, r *http.Request, out any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(out); err != nil {
+		return fmt.Errorf("Invalid request: %w", err)
+	}
+	return nil
+}
+
+func writeAdminResponse(w http.ResponseWriter, status int, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminResponse(w, status, map[string]string{"Error": message})
+}
+
+// Describes the players of the room, as of the next tick.
+func (self *Room) Players() []PlayerInfo {
+	players := []PlayerInfo{}
+	self.execute(func() {
+		self.players.Each(func(playerId types.PlayerId, playerConn *playerConnection) {
+			player := self.simulation.FindCorrespondingPlayer(playerId)
+			if player == nil {
+				return
+			}
+			playerData := component.Player.Get(player)
+
+			playerConn.mutex.Lock()
+			address, isConnected := playerConn.conn.RemoteAddr(), playerConn.isConnected
+			playerConn.mutex.Unlock()
+
+			roundTripTime, jitter := playerConn.latency.Get()
+			players = append(players, PlayerInfo{
+				RoomCode:      self.code,
+				PlayerId:      playerId,
+				Name:          playerData.Name,
+				Address:       address,
+				IsConnected:   isConnected,
+				RoundTripTime: roundTripTime.String(),
+				Jitter:        jitter.String(),
+				Score:         playerData.Score,
+				Health:        playerData.Health,
+			})
+		})
+	})
+
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].PlayerId < players[j].PlayerId
+	})
+	return players
+}
+
+// Disconnects the player, telling it why. Returns false when the player is
+// not connected.
+func (self *Room) Kick(playerId types.PlayerId, disconnected messages.Disconnected) bool {
+	playerConn := self.players.Get(playerId)
+	if playerConn == nil {
+		return false
+	}
+
+	playerConn.mutex.Lock()
+	connection, isConnected, logger := playerConn.conn, playerConn.isConnected, playerConn.logger
+	playerConn.mutex.Unlock()
+
+	if !isConnected {
+		return false
+	}
+	go self.kickPlayer(logger, connection, disconnected)
+	return true
+}
+
+// Shows the message to every player of the room.
+func (self *Room) Announce(message string) {
+	self.broadcastMessage(rpc.NewBaseMessage(messages.ServerAnnouncement{Message: message}))
+}
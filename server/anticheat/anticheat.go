@@ -0,0 +1,177 @@
+package anticheat
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"astro-blasters/game"
+	"astro-blasters/game/component"
+	"astro-blasters/game/types"
+	"astro-blasters/server/messages"
+)
+
+type Violation int
+
+const (
+	// The client is further from the server position than it could move.
+	ViolationSpeed Violation = iota
+	// The client is turned further from the server angle than it could turn.
+	ViolationRotation
+	// The client pulls the trigger faster than a human.
+	ViolationFireRate
+	// The move can not follow the previous ones, like starting to move
+	// forward twice in a row.
+	ViolationInvalidMove
+)
+
+func (self Violation) String() string {
+	switch self {
+	case ViolationSpeed:
+		return "speed"
+	case ViolationRotation:
+		return "rotation"
+	case ViolationFireRate:
+		return "fire rate"
+	case ViolationInvalidMove:
+		return "invalid move"
+	}
+	return fmt.Sprintf("violation %d", int(self))
+}
+
+// Whether the move can still be applied despite the violation. The position
+// of the player is then corrected by the server.
+func (self Violation) IsCorrectable() bool {
+	return self == ViolationSpeed || self == ViolationRotation
+}
+
+// What happens to the players that keep violating the rules.
+type Action int
+
+const (
+	// The offending moves are dropped or corrected, nothing more.
+	ActionCorrect Action = iota
+	ActionKick
+	// Kicks the player and refuses its address for a while.
+	ActionBan
+)
+
+func ParseAction(name string) (Action, error) {
+	switch name {
+	case "correct":
+		return ActionCorrect, nil
+	case "kick":
+		return ActionKick, nil
+	case "ban":
+		return ActionBan, nil
+	}
+	return ActionCorrect, fmt.Errorf("Unknown anti-cheat action %s, expected correct, kick or ban", name)
+}
+
+type Config struct {
+	// How far, in time of movement, the position reported by a client can be
+	// from the one of the server on top of its round trip time, which counts
+	// for MaxRewindTicks at most.
+	MoveTolerance time.Duration
+	// Shortest time between two presses of the trigger a human can manage.
+	MinFireInterval time.Duration
+
+	// How many violations within the window trigger the action.
+	MaxViolations   int
+	ViolationWindow time.Duration
+	Action          Action
+	BanDuration     time.Duration
+}
+
+// Tells apart the moves an honest client can send from the ones of a tampered
+// one. The server only applies moves to its own simulation, so a cheater can
+// not teleport, but it can lie about where it is and send moves that no key
+// press produces. Only used by the goroutine of the room of the player.
+type Tracker struct {
+	config *Config
+
+	lastSequence uint32
+	lastFire     time.Time
+
+	violations      int
+	violationsSince time.Time
+}
+
+func NewTracker(config *Config) *Tracker {
+	return &Tracker{config: config}
+}
+
+// Checks the move against the state of the player in the simulation of the
+// server, before the move is applied.
+func (self *Tracker) CheckMove(move messages.RegisterPlayerMove, player *component.PlayerData, position component.PositionData, roundTripTime time.Duration, now time.Time) []Violation {
+	violations := []Violation{}
+
+	if move.Sequence <= self.lastSequence || !isStateTransition(move.Move, player) {
+		violations = append(violations, ViolationInvalidMove)
+	}
+	self.lastSequence = max(self.lastSequence, move.Sequence)
+
+	if move.Move == types.PlayerStartFireBullet {
+		if !self.lastFire.IsZero() && now.Sub(self.lastFire) < self.config.MinFireInterval {
+			violations = append(violations, ViolationFireRate)
+		}
+		self.lastFire = now
+	}
+
+	// A client can slow down its heartbeats to look further away, which is
+	// only worth so much leeway.
+	latencyTicks := min(game.DurationToTicks(roundTripTime), game.MaxRewindTicks)
+	ticks := float64(latencyTicks + game.DurationToTicks(self.config.MoveTolerance))
+
+	distance := math.Hypot(move.Position.X-position.X, move.Position.Y-position.Y)
+	if distance > ticks*game.PlayerMovementSpeed {
+		violations = append(violations, ViolationSpeed)
+	}
+
+	if angleBetween(move.Position.Angle, position.Angle) > ticks*game.PlayerRotationSpeed*math.Pi/180 {
+		violations = append(violations, ViolationRotation)
+	}
+	return violations
+}
+
+// Counts the violations and tells what to do with the player.
+func (self *Tracker) Record(violations []Violation, now time.Time) Action {
+	if now.Sub(self.violationsSince) > self.config.ViolationWindow {
+		self.violations = 0
+		self.violationsSince = now
+	}
+	self.violations += len(violations)
+
+	if self.violations > self.config.MaxViolations {
+		return self.config.Action
+	}
+	return ActionCorrect
+}
+
+// Whether the move changes the state of the player the way a key press or
+// release does. Releases are not checked, the server clears the state of
+// the players that die while the keys are still held.
+func isStateTransition(move types.PlayerMove, player *component.PlayerData) bool {
+	switch move {
+	case types.PlayerStartForward:
+		return !player.IsMovingForward
+	case types.PlayerStartRotateClockwise:
+		return !player.IsRotatingClockwise
+	case types.PlayerStartRotateCounterClockwise:
+		return !player.IsRotatingCounterClockwise
+	case types.PlayerStartFireBullet:
+		return !player.IsFiringBullet
+	case types.PlayerStopForward,
+		types.PlayerStopRotateClockwise,
+		types.PlayerStopRotateCounterClockwise,
+		types.PlayerStopFireBullet:
+		return true
+	}
+	return false
+}
+
+// The smallest angle between the two, in radians.
+func angleBetween(a float64, b float64) float64 {
+	difference := math.Mod(math.Abs(a-b), 2*math.Pi)
+	return min(difference, 2*math.Pi-difference)
+}
@@ -0,0 +1,149 @@
+package anticheat
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"astro-blasters/game"
+	"astro-blasters/game/component"
+	"astro-blasters/game/types"
+	"astro-blasters/server/messages"
+)
+
+var testConfig = Config{
+	MoveTolerance:   250 * time.Millisecond,
+	MinFireInterval: 50 * time.Millisecond,
+	MaxViolations:   2,
+	ViolationWindow: 30 * time.Second,
+	Action:          ActionKick,
+	BanDuration:     10 * time.Minute,
+}
+
+var serverPosition = component.PositionData{X: 1000, Y: 1000, Angle: 1}
+
+func TestLegalMove(t *testing.T) {
+	tracker := NewTracker(&testConfig)
+	now := time.Now()
+
+	// Slightly behind the server, as a client is.
+	position := serverPosition
+	position.Forward(-10 * game.PlayerMovementSpeed)
+	position.Rotate(-10 * game.PlayerRotationSpeed)
+
+	moves := []types.PlayerMove{types.PlayerStartForward, types.PlayerStartFireBullet, types.PlayerStopForward}
+	for i, move := range moves {
+		violations := tracker.CheckMove(messages.RegisterPlayerMove{
+			Move:     move,
+			Sequence: uint32(i + 1),
+			Position: position,
+		}, &component.PlayerData{}, serverPosition, 0, now.Add(time.Duration(i)*time.Second))
+
+		if len(violations) != 0 {
+			t.Errorf("%d: got the violations %v, expected none", move, violations)
+		}
+	}
+}
+
+func TestTeleport(t *testing.T) {
+	tracker := NewTracker(&testConfig)
+
+	position := serverPosition
+	position.X += 1000
+	position.Angle += math.Pi
+
+	violations := tracker.CheckMove(messages.RegisterPlayerMove{
+		Move:     types.PlayerStartForward,
+		Sequence: 1,
+		Position: position,
+	}, &component.PlayerData{}, serverPosition, 0, time.Now())
+
+	if !slices.Equal(violations, []Violation{ViolationSpeed, ViolationRotation}) {
+		t.Errorf("Got the violations %v, expected speed and rotation", violations)
+	}
+}
+
+func TestLatencyAllowanceIsCapped(t *testing.T) {
+	position := serverPosition
+	position.Forward(40 * game.PlayerMovementSpeed)
+
+	move := func(tracker *Tracker, roundTripTime time.Duration) []Violation {
+		return tracker.CheckMove(messages.RegisterPlayerMove{
+			Move:     types.PlayerStartForward,
+			Sequence: 1,
+			Position: position,
+		}, &component.PlayerData{}, serverPosition, roundTripTime, time.Now())
+	}
+
+	// 40 ticks away is explained by a round trip of 500ms, on top of the
+	// tolerance of 15 ticks.
+	if violations := move(NewTracker(&testConfig), 500*time.Millisecond); len(violations) != 0 {
+		t.Errorf("Got the violations %v, expected none", violations)
+	}
+	if violations := move(NewTracker(&testConfig), 10*time.Second); len(violations) != 0 {
+		t.Errorf("Got the violations %v, expected none", violations)
+	}
+
+	position.Forward(20 * game.PlayerMovementSpeed)
+	if violations := move(NewTracker(&testConfig), 10*time.Second); !slices.Equal(violations, []Violation{ViolationSpeed}) {
+		t.Errorf("Got the violations %v with a made up latency, expected the speed", violations)
+	}
+}
+
+func TestFireRate(t *testing.T) {
+	tracker := NewTracker(&testConfig)
+	now := time.Now()
+
+	fire := func(sequence uint32, at time.Time) []Violation {
+		return tracker.CheckMove(messages.RegisterPlayerMove{
+			Move:     types.PlayerStartFireBullet,
+			Sequence: sequence,
+			Position: serverPosition,
+		}, &component.PlayerData{}, serverPosition, 0, at)
+	}
+
+	if violations := fire(1, now); len(violations) != 0 {
+		t.Errorf("Got the violations %v for the first shot, expected none", violations)
+	}
+	if violations := fire(2, now.Add(testConfig.MinFireInterval/2)); !slices.Equal(violations, []Violation{ViolationFireRate}) {
+		t.Errorf("Got the violations %v, expected the fire rate", violations)
+	}
+	if violations := fire(3, now.Add(2*testConfig.MinFireInterval)); len(violations) != 0 {
+		t.Errorf("Got the violations %v for a slow enough shot, expected none", violations)
+	}
+}
+
+func TestReplayedMove(t *testing.T) {
+	tracker := NewTracker(&testConfig)
+	move := messages.RegisterPlayerMove{Move: types.PlayerStopForward, Sequence: 5, Position: serverPosition}
+	now := time.Now()
+
+	tracker.CheckMove(move, &component.PlayerData{}, serverPosition, 0, now)
+	if violations := tracker.CheckMove(move, &component.PlayerData{}, serverPosition, 0, now); !slices.Equal(violations, []Violation{ViolationInvalidMove}) {
+		t.Errorf("Got the violations %v, expected an invalid move", violations)
+	}
+}
+
+func TestViolationThresholds(t *testing.T) {
+	for _, action := range []Action{ActionKick, ActionBan} {
+		config := testConfig
+		config.Action = action
+		tracker := NewTracker(&config)
+		now := time.Now()
+
+		for i := range config.MaxViolations {
+			if got := tracker.Record([]Violation{ViolationSpeed}, now); got != ActionCorrect {
+				t.Fatalf("Got the action %d after %d violations, expected to correct", got, i+1)
+			}
+		}
+		if got := tracker.Record([]Violation{ViolationSpeed}, now); got != action {
+			t.Errorf("Got the action %d past the threshold, expected %d", got, action)
+		}
+
+		// The count starts over with the next window.
+		if got := tracker.Record([]Violation{ViolationSpeed}, now.Add(2*config.ViolationWindow)); got != ActionCorrect {
+			t.Errorf("Got the action %d in a new window, expected to correct", got)
+		}
+	}
+}
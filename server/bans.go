@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A player refused by the server until the ban expires. Either the address
+// or the name is set.
+type Ban struct {
+	Address string `json:",omitempty"`
+	Name    string `json:",omitempty"`
+	Until   time.Time
+	Reason  string
+}
+
+func (self Ban) key() string {
+	if self.Address != "" {
+		return "address:" + banHost(self.Address)
+	}
+	return "name:" + strings.ToLower(self.Name)
+}
+
+// The bans of the server, saved to a file when a path is given so that they
+// survive restarts.
+type banList struct {
+	mutex sync.Mutex
+	path  string
+	bans  map[string]Ban
+}
+
+func newBanList(path string) (*banList, error) {
+	list := &banList{path: path, bans: make(map[string]Ban)}
+	if path == "" {
+		return list, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, fmt.Errorf("Invalid bans file %s: %w", path, err)
+	}
+	for _, ban := range bans {
+		list.bans[ban.key()] = ban
+	}
+	return list, nil
+}
+
+func (self *banList) Add(ban Ban) error {
+	if (ban.Address == "") == (ban.Name == "") {
+		return errors.New("A ban needs either an address or a name")
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.bans[ban.key()] = ban
+	return self.save()
+}
+
+// Returns the ban of the player connecting from the address with the name,
+// if any.
+func (self *banList) Find(address string, name string) (Ban, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, key := range []string{Ban{Address: address}.key(), Ban{Name: name}.key()} {
+		ban, ok := self.bans[key]
+		if !ok {
+			continue
+		}
+		if time.Now().After(ban.Until) {
+			delete(self.bans, key)
+			continue
+		}
+		return ban, true
+	}
+	return Ban{}, false
+}
+
+func (self *banList) Save() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.save()
+}
+
+// Returns the bans that did not expire yet, the soonest to expire first.
+func (self *banList) List() []Ban {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	bans := []Ban{}
+	now := time.Now()
+	for _, ban := range self.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	sortBans(bans)
+	return bans
+}
+
+// Writes the bans that did not expire yet to the file. The file is replaced
+// at once so that a crash can not leave it half written.
+func (self *banList) save() error {
+	if self.path == "" {
+		return nil
+	}
+
+	bans := []Ban{}
+	now := time.Now()
+	for _, ban := range self.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	sortBans(bans)
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temporary := self.path + ".tmp"
+	if err := os.WriteFile(temporary, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, self.path)
+}
+
+func sortBans(bans []Ban) {
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+}
+
+// Bans apply to the host whatever the port it connects from.
+func banHost(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"astro-blasters/server/anticheat"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ServerConfig struct {
+	// How many times per second the server sends a full snapshot of the world
+	// to every client.
+	SnapshotRate int
+
+	// How far back bullet collisions are rewound to make up for the latency
+	// of the shooter.
+	LagCompensationWindow time.Duration
+
+	// Secret used to sign the session tokens, a random one is used when empty.
+	SessionSecret string
+	// How long a disconnected player can reconnect and keep its ship. Its
+	// ship is removed from the room afterwards.
+	ReconnectGracePeriod time.Duration
+
+	// How many players, connected or not, a single room can hold.
+	MaxPlayers int
+	// How many rooms can be open at once.
+	MaxRooms int
+
+	// Size in bytes of the largest message accepted from a client.
+	MaxMessageSize int64
+
+	// Codec used with every client that supports it, the one preferred by
+	// each client when empty.
+	Codec string
+
+	// How often the clients are pinged, and how many pings in a row they can
+	// leave unanswered before being dropped.
+	HeartbeatInterval   time.Duration
+	MaxMissedHeartbeats int
+
+	// How many messages can wait to be sent to a client. Clients that fall
+	// further behind are disconnected.
+	SendQueueSize int
+
+	// How many messages of each kind a client can send, messages over the
+	// limits are dropped. The default limit applies to the other kinds.
+	MoveRateLimit         RateLimit
+	AcknowledgeRateLimit  RateLimit
+	HeartbeatAckRateLimit RateLimit
+	DefaultRateLimit      RateLimit
+	// How many lobby requests, such as listing or creating rooms, a single
+	// address can make.
+	LobbyRateLimit RateLimit
+	// How many messages over the limits a client can send within the window
+	// before being disconnected.
+	MaxRateViolations   int
+	RateViolationWindow time.Duration
+
+	// How long a player waits between two shots.
+	FireCooldown time.Duration
+	AntiCheat    anticheat.Config
+
+	// Bearer token of the /admin API, which is disabled when empty.
+	AdminToken string
+	// File the bans are kept in across restarts, they only last as long as
+	// the process when empty.
+	BansFile string
+
+	// How long the clients are warned before the server shuts down.
+	ShutdownCountdown time.Duration
+}
+
+type RateLimit struct {
+	// Messages per second allowed in the long run.
+	Rate float64
+	// How many messages can arrive at once.
+	Burst int
+}
+
+// Parses a limit written as "rate:burst", like "30:10".
+func ParseRateLimit(value string) (RateLimit, error) {
+	rate, burst, found := strings.Cut(value, ":")
+	if !found {
+		return RateLimit{}, fmt.Errorf("Invalid rate limit %q, expected rate:burst", value)
+	}
+
+	parsedRate, err := strconv.ParseFloat(rate, 64)
+	if err != nil || parsedRate <= 0 {
+		return RateLimit{}, fmt.Errorf("Invalid rate in the rate limit %q", value)
+	}
+	parsedBurst, err := strconv.Atoi(burst)
+	if err != nil || parsedBurst <= 0 {
+		return RateLimit{}, fmt.Errorf("Invalid burst in the rate limit %q", value)
+	}
+	return RateLimit{Rate: parsedRate, Burst: parsedBurst}, nil
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"astro-blasters/game/types"
+	"astro-blasters/rpc"
+	"astro-blasters/server/messages"
+)
+
+// Smoothed round trip time and jitter of a connection, estimated the way TCP
+// does (RFC 6298).
+type latencyEstimator struct {
+	mutex         sync.Mutex
+	roundTripTime time.Duration
+	jitter        time.Duration
+	lastAnswer    time.Time
+
+	// When each unanswered heartbeat was sent, by sequence. The round trip is
+	// measured against these rather than the time echoed by the client, which
+	// it could make up.
+	sequence uint32
+	pending  map[uint32]time.Time
+}
+
+// Remembers when the next heartbeat is sent and returns its sequence.
+func (self *latencyEstimator) Sent(now time.Time) uint32 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.pending == nil {
+		self.pending = make(map[uint32]time.Time)
+	}
+	self.sequence += 1
+	self.pending[self.sequence] = now
+	return self.sequence
+}
+
+// Measures the round trip of the heartbeat with the given sequence and send
+// time. Answers to unknown heartbeats, answers echoing another send time and
+// round trips longer than the timeout are ignored.
+func (self *latencyEstimator) Acknowledge(sequence uint32, echoedSentAt int64, now time.Time, timeout time.Duration) bool {
+	self.mutex.Lock()
+	sentAt, found := self.pending[sequence]
+	found = found && sentAt.UnixNano() == echoedSentAt
+	// The heartbeats are answered in order, the older ones are lost.
+	for pending := range self.pending {
+		if pending <= sequence {
+			delete(self.pending, pending)
+		}
+	}
+	self.mutex.Unlock()
+
+	sample := now.Sub(sentAt)
+	if !found || sample < 0 || sample > timeout {
+		return false
+	}
+	self.AddSample(sample)
+	return true
+}
+
+func (self *latencyEstimator) AddSample(sample time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.lastAnswer = time.Now()
+	if self.roundTripTime == 0 {
+		self.roundTripTime = sample
+		self.jitter = sample / 2
+		return
+	}
+
+	deviation := max(self.roundTripTime-sample, sample-self.roundTripTime)
+	self.jitter += (deviation - self.jitter) / 4
+	self.roundTripTime += (sample - self.roundTripTime) / 8
+}
+
+func (self *latencyEstimator) Get() (roundTripTime time.Duration, jitter time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.roundTripTime, self.jitter
+}
+
+// Gives a new connection the full timeout to answer its first heartbeat.
+func (self *latencyEstimator) Restart() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.lastAnswer = time.Now()
+	clear(self.pending)
+}
+
+func (self *latencyEstimator) SinceLastAnswer() time.Duration {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return time.Since(self.lastAnswer)
+}
+
+// Pings the client until the context is done, closing the connection once
+// the client left too many pings unanswered in a row.
+func (self *Room) sendHeartbeats(ctx context.Context, playerId types.PlayerId, playerConn *playerConnection, connection rpc.Transport) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logPanic(playerConn.Logger(), recovered)
+			connection.Close()
+		}
+	}()
+
+	latency := &playerConn.latency
+	latency.Restart()
+
+	ticker := time.NewTicker(self.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	timeout := self.heartbeatTimeout()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if latency.SinceLastAnswer() > timeout {
+			playerConn.Logger().Warn("Player stopped answering heartbeats", "timeout", timeout)
+			connection.Close()
+			return
+		}
+
+		roundTripTime, jitter := latency.Get()
+		now := time.Now()
+		self.sendMessage(playerId, playerConn, rpc.NewBaseMessage(messages.Heartbeat{
+			Sequence:      latency.Sent(now),
+			SentAt:        now.UnixNano(),
+			RoundTripTime: roundTripTime,
+			Jitter:        jitter,
+		}))
+	}
+}
+
+// How long a client can leave the heartbeats unanswered before it is dropped.
+func (self *Room) heartbeatTimeout() time.Duration {
+	return self.config.HeartbeatInterval * time.Duration(self.config.MaxMissedHeartbeats)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatRoundTrip(t *testing.T) {
+	var latency latencyEstimator
+	sentAt := time.Now()
+	sequence := latency.Sent(sentAt)
+
+	if !latency.Acknowledge(sequence, sentAt.UnixNano(), sentAt.Add(40*time.Millisecond), time.Second) {
+		t.Fatal("The answer to the heartbeat was ignored")
+	}
+	if roundTripTime, _ := latency.Get(); roundTripTime != 40*time.Millisecond {
+		t.Errorf("Got a round trip time of %s, expected 40ms", roundTripTime)
+	}
+
+	// Answering twice does not count twice.
+	if latency.Acknowledge(sequence, sentAt.UnixNano(), sentAt.Add(time.Millisecond), time.Second) {
+		t.Error("The same heartbeat was answered twice")
+	}
+}
+
+func TestIgnoredHeartbeatAnswers(t *testing.T) {
+	var latency latencyEstimator
+	sentAt := time.Now()
+
+	tests := map[string]func() bool{
+		"unknown sequence": func() bool {
+			return latency.Acknowledge(latency.Sent(sentAt)+1, sentAt.UnixNano(), sentAt.Add(time.Millisecond), time.Second)
+		},
+		"other send time": func() bool {
+			return latency.Acknowledge(latency.Sent(sentAt), sentAt.Add(-time.Second).UnixNano(), sentAt.Add(time.Millisecond), time.Second)
+		},
+		"answered before being sent": func() bool {
+			return latency.Acknowledge(latency.Sent(sentAt), sentAt.UnixNano(), sentAt.Add(-time.Millisecond), time.Second)
+		},
+		"answered after the timeout": func() bool {
+			return latency.Acknowledge(latency.Sent(sentAt), sentAt.UnixNano(), sentAt.Add(2*time.Second), time.Second)
+		},
+		"sent before the restart": func() bool {
+			sequence := latency.Sent(sentAt)
+			latency.Restart()
+			return latency.Acknowledge(sequence, sentAt.UnixNano(), sentAt.Add(time.Millisecond), time.Second)
+		},
+	}
+
+	for name, answer := range tests {
+		if answer() {
+			t.Errorf("%s: the answer was counted", name)
+		}
+	}
+	if roundTripTime, _ := latency.Get(); roundTripTime != 0 {
+		t.Errorf("Got a round trip time of %s, expected none", roundTripTime)
+	}
+}
+
+func TestHeartbeatsAnsweredOutOfOrder(t *testing.T) {
+	var latency latencyEstimator
+	sentAt := time.Now()
+	first := latency.Sent(sentAt)
+	second := latency.Sent(sentAt.Add(time.Second))
+
+	if !latency.Acknowledge(second, sentAt.Add(time.Second).UnixNano(), sentAt.Add(1100*time.Millisecond), 5*time.Second) {
+		t.Fatal("The answer to the last heartbeat was ignored")
+	}
+	if latency.Acknowledge(first, sentAt.UnixNano(), sentAt.Add(1200*time.Millisecond), 5*time.Second) {
+		t.Error("The answer to a heartbeat older than an answered one was counted")
+	}
+	if len(latency.pending) != 0 {
+		t.Errorf("%d heartbeats still pending, expected none", len(latency.pending))
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"time"
+
+	"astro-blasters/rpc"
+	"astro-blasters/server/anticheat"
+	"astro-blasters/server/config"
+)
+
+// The defaults of the server command, with a short grace period and
+// countdown to keep the tests fast.
+func newTestConfig() *config.ServerConfig {
+	return &config.ServerConfig{
+		SnapshotRate:          20,
+		LagCompensationWindow: 200 * time.Millisecond,
+		ReconnectGracePeriod:  time.Second,
+		MaxPlayers:            16,
+		MaxRooms:              64,
+		MaxMessageSize:        rpc.DefaultMaxMessageSize,
+		HeartbeatInterval:     time.Second,
+		MaxMissedHeartbeats:   5,
+		SendQueueSize:         256,
+		MoveRateLimit:         config.RateLimit{Rate: 30, Burst: 20},
+		AcknowledgeRateLimit:  config.RateLimit{Rate: 60, Burst: 20},
+		HeartbeatAckRateLimit: config.RateLimit{Rate: 5, Burst: 5},
+		DefaultRateLimit:      config.RateLimit{Rate: 5, Burst: 5},
+		LobbyRateLimit:        config.RateLimit{Rate: 1, Burst: 5},
+		MaxRateViolations:     50,
+		RateViolationWindow:   10 * time.Second,
+		FireCooldown:          300 * time.Millisecond,
+		AntiCheat: anticheat.Config{
+			MoveTolerance:   250 * time.Millisecond,
+			MinFireInterval: 50 * time.Millisecond,
+			MaxViolations:   20,
+			ViolationWindow: 30 * time.Second,
+			Action:          anticheat.ActionCorrect,
+			BanDuration:     10 * time.Minute,
+		},
+		ShutdownCountdown: 100 * time.Millisecond,
+	}
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Creates a logger writing to the standard error, as text or json, of the
+// messages at the level or above (debug, info, warn or error).
+func NewLogger(format string, level string) (*slog.Logger, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("Unknown log level %s", level)
+	}
+
+	options := &slog.HandlerOptions{Level: minLevel}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
+	default:
+		return nil, fmt.Errorf("Unknown log format %s", format)
+	}
+}
@@ -0,0 +1,279 @@
+package messages
+
+import (
+	"astro-blasters/game/component"
+	"astro-blasters/game/types"
+)
+
+func DiffPosition(base, current component.PositionData) PositionDiff {
+	diff := PositionDiff{}
+	if base.X != current.X {
+		diff.Changed |= PositionX
+		diff.X = current.X
+	}
+	if base.Y != current.Y {
+		diff.Changed |= PositionY
+		diff.Y = current.Y
+	}
+	if base.Angle != current.Angle {
+		diff.Changed |= PositionAngle
+		diff.Angle = current.Angle
+	}
+	return diff
+}
+
+func ApplyPositionDiff(base component.PositionData, diff PositionDiff) component.PositionData {
+	if diff.Changed&PositionX != 0 {
+		base.X = diff.X
+	}
+	if diff.Changed&PositionY != 0 {
+		base.Y = diff.Y
+	}
+	if diff.Changed&PositionAngle != 0 {
+		base.Angle = diff.Angle
+	}
+	return base
+}
+
+// The id of a player never changes, so it is not part of the diff.
+func DiffPlayer(base, current component.PlayerData) PlayerDiff {
+	diff := PlayerDiff{}
+	if base.Name != current.Name {
+		diff.Changed |= PlayerName
+		diff.Name = current.Name
+	}
+	if base.Health != current.Health {
+		diff.Changed |= PlayerHealth
+		diff.Health = current.Health
+	}
+	if base.Score != current.Score {
+		diff.Changed |= PlayerScore
+		diff.Score = current.Score
+	}
+	if base.IsAlive != current.IsAlive {
+		diff.Changed |= PlayerIsAlive
+		diff.IsAlive = current.IsAlive
+	}
+	if base.IsConnected != current.IsConnected {
+		diff.Changed |= PlayerIsConnected
+		diff.IsConnected = current.IsConnected
+	}
+	if base.IsRotatingClockwise != current.IsRotatingClockwise {
+		diff.Changed |= PlayerIsRotatingClockwise
+		diff.IsRotatingClockwise = current.IsRotatingClockwise
+	}
+	if base.IsRotatingCounterClockwise != current.IsRotatingCounterClockwise {
+		diff.Changed |= PlayerIsRotatingCounterClockwise
+		diff.IsRotatingCounterClockwise = current.IsRotatingCounterClockwise
+	}
+	if base.IsMovingForward != current.IsMovingForward {
+		diff.Changed |= PlayerIsMovingForward
+		diff.IsMovingForward = current.IsMovingForward
+	}
+	if base.IsFiringBullet != current.IsFiringBullet {
+		diff.Changed |= PlayerIsFiringBullet
+		diff.IsFiringBullet = current.IsFiringBullet
+	}
+	return diff
+}
+
+func ApplyPlayerDiff(base component.PlayerData, diff PlayerDiff) component.PlayerData {
+	if diff.Changed&PlayerName != 0 {
+		base.Name = diff.Name
+	}
+	if diff.Changed&PlayerHealth != 0 {
+		base.Health = diff.Health
+	}
+	if diff.Changed&PlayerScore != 0 {
+		base.Score = diff.Score
+	}
+	if diff.Changed&PlayerIsAlive != 0 {
+		base.IsAlive = diff.IsAlive
+	}
+	if diff.Changed&PlayerIsConnected != 0 {
+		base.IsConnected = diff.IsConnected
+	}
+	if diff.Changed&PlayerIsRotatingClockwise != 0 {
+		base.IsRotatingClockwise = diff.IsRotatingClockwise
+	}
+	if diff.Changed&PlayerIsRotatingCounterClockwise != 0 {
+		base.IsRotatingCounterClockwise = diff.IsRotatingCounterClockwise
+	}
+	if diff.Changed&PlayerIsMovingForward != 0 {
+		base.IsMovingForward = diff.IsMovingForward
+	}
+	if diff.Changed&PlayerIsFiringBullet != 0 {
+		base.IsFiringBullet = diff.IsFiringBullet
+	}
+	return base
+}
+
+func DiffBullet(base, current BulletSnapshot) BulletSnapshotDelta {
+	return BulletSnapshotDelta{
+		Id:       current.Id,
+		FiredBy:  current.FiredBy,
+		Position: DiffPosition(base.Position, current.Position),
+	}
+}
+
+func ApplyBulletDiff(base BulletSnapshot, diff BulletSnapshotDelta) BulletSnapshot {
+	return BulletSnapshot{
+		Id:       diff.Id,
+		FiredBy:  diff.FiredBy,
+		Position: ApplyPositionDiff(base.Position, diff.Position),
+	}
+}
+
+// Computes the changes needed to turn the base snapshot into the current one.
+// Entities missing from the base are diffed against their zero value.
+func DiffSnapshot(base, current WorldSnapshot) WorldSnapshotDelta {
+	delta := WorldSnapshotDelta{
+		Tick:                  current.Tick,
+		BaseTick:              base.Tick,
+		LastProcessedSequence: current.LastProcessedSequence,
+		LastProcessedTick:     current.LastProcessedTick,
+	}
+
+	basePlayers := make(map[types.PlayerId]PlayerSnapshot, len(base.Players))
+	for _, player := range base.Players {
+		basePlayers[player.Player.Id] = player
+	}
+	for _, player := range current.Players {
+		basePlayer, existed := basePlayers[player.Player.Id]
+		delete(basePlayers, player.Player.Id)
+
+		playerDelta := PlayerSnapshotDelta{
+			PlayerId: player.Player.Id,
+			Player:   DiffPlayer(basePlayer.Player, player.Player),
+			Position: DiffPosition(basePlayer.Position, player.Position),
+		}
+		if existed && playerDelta.Player.Changed == 0 && playerDelta.Position.Changed == 0 {
+			continue
+		}
+		delta.Players = append(delta.Players, playerDelta)
+	}
+	for _, player := range base.Players {
+		if _, removed := basePlayers[player.Player.Id]; removed {
+			delta.RemovedPlayers = append(delta.RemovedPlayers, player.Player.Id)
+		}
+	}
+
+	baseBullets := make(map[uint64]BulletSnapshot, len(base.Bullets))
+	for _, bullet := range base.Bullets {
+		baseBullets[bullet.Id] = bullet
+	}
+	for _, bullet := range current.Bullets {
+		baseBullet, existed := baseBullets[bullet.Id]
+		delete(baseBullets, bullet.Id)
+
+		bulletDelta := DiffBullet(baseBullet, bullet)
+		if existed && bulletDelta.Position.Changed == 0 {
+			continue
+		}
+		delta.Bullets = append(delta.Bullets, bulletDelta)
+	}
+	for _, bullet := range base.Bullets {
+		if _, removed := baseBullets[bullet.Id]; removed {
+			delta.RemovedBullets = append(delta.RemovedBullets, bullet.Id)
+		}
+	}
+
+	baseExplosions := make(map[uint64]bool, len(base.Explosions))
+	for _, explosion := range base.Explosions {
+		baseExplosions[explosion.Id] = true
+	}
+	for _, explosion := range current.Explosions {
+		if baseExplosions[explosion.Id] {
+			delete(baseExplosions, explosion.Id)
+			continue
+		}
+		delta.Explosions = append(delta.Explosions, explosion)
+	}
+	for _, explosion := range base.Explosions {
+		if baseExplosions[explosion.Id] {
+			delta.RemovedExplosions = append(delta.RemovedExplosions, explosion.Id)
+		}
+	}
+
+	return delta
+}
+
+// Reconstructs the current snapshot from the base and the delta against it.
+func ApplySnapshotDelta(base WorldSnapshot, delta WorldSnapshotDelta) WorldSnapshot {
+	snapshot := WorldSnapshot{
+		Tick:                  delta.Tick,
+		Players:               []PlayerSnapshot{},
+		Bullets:               []BulletSnapshot{},
+		Explosions:            []ExplosionSnapshot{},
+		LastProcessedSequence: delta.LastProcessedSequence,
+		LastProcessedTick:     delta.LastProcessedTick,
+	}
+
+	removedPlayers := make(map[types.PlayerId]bool, len(delta.RemovedPlayers))
+	for _, playerId := range delta.RemovedPlayers {
+		removedPlayers[playerId] = true
+	}
+	playerDeltas := make(map[types.PlayerId]PlayerSnapshotDelta, len(delta.Players))
+	for _, playerDelta := range delta.Players {
+		playerDeltas[playerDelta.PlayerId] = playerDelta
+	}
+	for _, player := range base.Players {
+		if removedPlayers[player.Player.Id] {
+			continue
+		}
+		if playerDelta, ok := playerDeltas[player.Player.Id]; ok {
+			player.Player = ApplyPlayerDiff(player.Player, playerDelta.Player)
+			player.Position = ApplyPositionDiff(player.Position, playerDelta.Position)
+			delete(playerDeltas, player.Player.Id)
+		}
+		snapshot.Players = append(snapshot.Players, player)
+	}
+	for _, playerDelta := range delta.Players {
+		if _, isNew := playerDeltas[playerDelta.PlayerId]; !isNew {
+			continue
+		}
+		player := PlayerSnapshot{
+			Player:   ApplyPlayerDiff(component.PlayerData{}, playerDelta.Player),
+			Position: ApplyPositionDiff(component.PositionData{}, playerDelta.Position),
+		}
+		player.Player.Id = playerDelta.PlayerId
+		snapshot.Players = append(snapshot.Players, player)
+	}
+
+	removedBullets := make(map[uint64]bool, len(delta.RemovedBullets))
+	for _, id := range delta.RemovedBullets {
+		removedBullets[id] = true
+	}
+	bulletDeltas := make(map[uint64]BulletSnapshotDelta, len(delta.Bullets))
+	for _, bulletDelta := range delta.Bullets {
+		bulletDeltas[bulletDelta.Id] = bulletDelta
+	}
+	for _, bullet := range base.Bullets {
+		if removedBullets[bullet.Id] {
+			continue
+		}
+		if bulletDelta, ok := bulletDeltas[bullet.Id]; ok {
+			bullet = ApplyBulletDiff(bullet, bulletDelta)
+			delete(bulletDeltas, bullet.Id)
+		}
+		snapshot.Bullets = append(snapshot.Bullets, bullet)
+	}
+	for _, bulletDelta := range delta.Bullets {
+		if _, isNew := bulletDeltas[bulletDelta.Id]; isNew {
+			snapshot.Bullets = append(snapshot.Bullets, ApplyBulletDiff(BulletSnapshot{}, bulletDelta))
+		}
+	}
+
+	removedExplosions := make(map[uint64]bool, len(delta.RemovedExplosions))
+	for _, id := range delta.RemovedExplosions {
+		removedExplosions[id] = true
+	}
+	for _, explosion := range base.Explosions {
+		if !removedExplosions[explosion.Id] {
+			snapshot.Explosions = append(snapshot.Explosions, explosion)
+		}
+	}
+	snapshot.Explosions = append(snapshot.Explosions, delta.Explosions...)
+
+	return snapshot
+}
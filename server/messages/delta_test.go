@@ -0,0 +1,136 @@
+package messages
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"astro-blasters/game/component"
+	"astro-blasters/game/types"
+	"astro-blasters/rpc"
+)
+
+func player(id int, name string, health float64, position component.PositionData) PlayerSnapshot {
+	return PlayerSnapshot{
+		Player:   component.PlayerData{Id: types.PlayerId(id), Name: name, Health: health, IsAlive: health > 0, IsConnected: true},
+		Position: position,
+	}
+}
+
+// Sorts the entities by id, since a delta does not keep their order.
+func normalize(snapshot WorldSnapshot) WorldSnapshot {
+	sort.Slice(snapshot.Players, func(i, j int) bool {
+		return snapshot.Players[i].Player.Id < snapshot.Players[j].Player.Id
+	})
+	sort.Slice(snapshot.Bullets, func(i, j int) bool {
+		return snapshot.Bullets[i].Id < snapshot.Bullets[j].Id
+	})
+	sort.Slice(snapshot.Explosions, func(i, j int) bool {
+		return snapshot.Explosions[i].Id < snapshot.Explosions[j].Id
+	})
+	return snapshot
+}
+
+// Sends the delta through every codec, so that the fields left out by
+// omitempty are part of the round trip.
+func transmit(t *testing.T, delta WorldSnapshotDelta) []WorldSnapshotDelta {
+	transmitted := []WorldSnapshotDelta{}
+	for _, codec := range []rpc.Codec{rpc.MsgpackCodec, rpc.JSONCodec} {
+		payload, err := codec.EncodePayload(delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded WorldSnapshotDelta
+		if err := codec.DecodePayload(payload, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		transmitted = append(transmitted, decoded)
+	}
+	return transmitted
+}
+
+func TestSnapshotDeltaRoundTrip(t *testing.T) {
+	base := WorldSnapshot{
+		Tick: 10,
+		Players: []PlayerSnapshot{
+			player(0, "kept", 100, component.PositionData{X: 10, Y: 20, Angle: 1}),
+			player(1, "moved", 100, component.PositionData{X: 30, Y: 40, Angle: 2}),
+			player(2, "removed", 100, component.PositionData{X: 50, Y: 60}),
+			player(3, "killed", 40, component.PositionData{X: 70, Y: 80, Angle: 3}),
+		},
+		Bullets: []BulletSnapshot{
+			{Id: 100, FiredBy: 0, Position: component.PositionData{X: 1, Y: 2}},
+			{Id: 101, FiredBy: 1, Position: component.PositionData{X: 3, Y: 4}},
+			{Id: 102, FiredBy: 1, Position: component.PositionData{X: 5, Y: 6}},
+		},
+		Explosions: []ExplosionSnapshot{
+			{Id: 200, Count: 3, Position: component.PositionData{X: 7, Y: 8}},
+			{Id: 201, Count: 1, Position: component.PositionData{X: 9, Y: 10}},
+		},
+	}
+
+	target := WorldSnapshot{
+		Tick: 12,
+		Players: []PlayerSnapshot{
+			player(0, "kept", 100, component.PositionData{X: 10, Y: 20, Angle: 1}),
+			// Back to zero values, which omitempty leaves out of the payload.
+			player(1, "moved", 100, component.PositionData{X: 0, Y: 40, Angle: 0}),
+			player(3, "killed", 0, component.PositionData{X: 70, Y: 80, Angle: 3}),
+			player(4, "joined", 100, component.PositionData{X: 90, Y: 0}),
+		},
+		Bullets: []BulletSnapshot{
+			{Id: 100, FiredBy: 0, Position: component.PositionData{X: 1, Y: 2}},
+			{Id: 101, FiredBy: 1, Position: component.PositionData{X: 0, Y: 14}},
+			{Id: 103, FiredBy: 4, Position: component.PositionData{X: 11, Y: 12}},
+		},
+		Explosions: []ExplosionSnapshot{
+			{Id: 201, Count: 1, Position: component.PositionData{X: 9, Y: 10}},
+			{Id: 202, Count: 2, Position: component.PositionData{X: 13, Y: 14}},
+		},
+		LastProcessedSequence: 7,
+		LastProcessedTick:     11,
+	}
+
+	delta := DiffSnapshot(base, target)
+	if len(delta.RemovedPlayers) != 1 || len(delta.RemovedBullets) != 1 || len(delta.RemovedExplosions) != 1 {
+		t.Errorf("Expected one removed player, bullet and explosion, got %v, %v and %v", delta.RemovedPlayers, delta.RemovedBullets, delta.RemovedExplosions)
+	}
+	if len(delta.Players) != 3 {
+		t.Errorf("Expected the 3 players that changed or joined in the delta, got %d", len(delta.Players))
+	}
+
+	for _, transmitted := range transmit(t, delta) {
+		applied := normalize(ApplySnapshotDelta(base, transmitted))
+		if expected := normalize(target); !reflect.DeepEqual(applied, expected) {
+			t.Errorf("Applying the delta gave\n%+v\nexpected\n%+v", applied, expected)
+		}
+	}
+}
+
+func TestSnapshotDeltaFromEmptyBase(t *testing.T) {
+	target := WorldSnapshot{
+		Tick:       5,
+		Players:    []PlayerSnapshot{player(0, "alone", 100, component.PositionData{X: 1, Y: 2, Angle: 3})},
+		Bullets:    []BulletSnapshot{{Id: 1, FiredBy: 0, Position: component.PositionData{X: 4}}},
+		Explosions: []ExplosionSnapshot{{Id: 2, Count: 1}},
+	}
+
+	for _, transmitted := range transmit(t, DiffSnapshot(WorldSnapshot{}, target)) {
+		if applied := ApplySnapshotDelta(WorldSnapshot{}, transmitted); !reflect.DeepEqual(normalize(applied), normalize(target)) {
+			t.Errorf("Applying the delta gave\n%+v\nexpected\n%+v", applied, target)
+		}
+	}
+}
+
+func TestUnchangedSnapshotHasEmptyDelta(t *testing.T) {
+	snapshot := WorldSnapshot{
+		Tick:    3,
+		Players: []PlayerSnapshot{player(0, "idle", 100, component.PositionData{X: 1, Y: 2})},
+		Bullets: []BulletSnapshot{{Id: 1, Position: component.PositionData{X: 4}}},
+	}
+
+	delta := DiffSnapshot(snapshot, snapshot)
+	if len(delta.Players) != 0 || len(delta.Bullets) != 0 || len(delta.Explosions) != 0 {
+		t.Errorf("Expected an empty delta, got %+v", delta)
+	}
+}
@@ -3,6 +3,7 @@ package messages
 import (
 	"astro-blasters/game/component"
 	"astro-blasters/game/types"
+	"time"
 )
 
 type PlayerData struct {
@@ -12,18 +13,107 @@ type PlayerData struct {
 	IsConnected bool
 }
 
+// Message sent from the client to the server to join the room with the
+// given code.
 type ConnectionHandshake struct {
+	ProtocolVersion int
+	Capabilities    Capabilities
+	// Names of the codecs the client can write, the preferred one first.
+	Codecs []string
+
 	PlayerName string
+	RoomCode   string
+
+	// Token of a previous session, used to take over the same ship again
+	// after the connection dropped.
+	SessionToken string
 }
 
 type ConnectionHandshakeResponse struct {
-	PlayerId   types.PlayerId
-	PlayerData []PlayerData
+	// The version and the capabilities that both sides agreed on.
+	ProtocolVersion int
+	Capabilities    Capabilities
+	// The codec both sides write with from now on.
+	Codec string
+
+	PlayerId     types.PlayerId
+	PlayerData   []PlayerData
+	RoomCode     string
+	SessionToken string
 }
 
-type UpdatePosition struct {
-	PlayerId types.PlayerId
-	Position component.PositionData
+type RejectionReason int
+
+const (
+	RejectRoomNotFound RejectionReason = iota
+	RejectRoomFull
+	RejectIncompatibleVersion
+	RejectBanned
+	RejectShuttingDown
+	RejectTooManyRooms
+	RejectRateLimited
+)
+
+// Message sent from the server to the client when the handshake or a lobby
+// request is refused.
+type HandshakeRejected struct {
+	Reason  RejectionReason
+	Message string
+}
+
+func (self HandshakeRejected) Error() string {
+	return self.Message
+}
+
+type DisconnectReason int
+
+const (
+	// No reason given, so that a missing reason is never mistaken for another.
+	DisconnectUnknown DisconnectReason = iota
+	DisconnectRateLimited
+	DisconnectCheating
+	DisconnectBanned
+	DisconnectKicked
+	// The server failed to handle the connection of the client.
+	DisconnectServerError
+	DisconnectServerShutdown
+	DisconnectMessageTooLarge
+)
+
+// Message sent from the server to the client right before closing its
+// connection. The client should not try to reconnect.
+type Disconnected struct {
+	Reason  DisconnectReason
+	Message string
+}
+
+func (self Disconnected) Error() string {
+	return self.Message
+}
+
+// Message sent from the client to the server to get the rooms that can be
+// joined.
+type ListRooms struct {
+	ProtocolVersion int
+}
+
+type RoomInfo struct {
+	RoomCode    string
+	PlayerCount int
+}
+
+type ListRoomsResponse struct {
+	Rooms []RoomInfo
+}
+
+// Message sent from the client to the server to open a new room. The client
+// joins it afterwards through a ConnectionHandshake.
+type CreateRoom struct {
+	ProtocolVersion int
+}
+
+type CreateRoomResponse struct {
+	RoomCode string
 }
 
 // Message sent from the client to the server to tell the
@@ -31,6 +121,13 @@ type UpdatePosition struct {
 type RegisterPlayerMove struct {
 	Move types.PlayerMove
 
+	// Increases with every move so the server can tell the client which moves
+	// are already part of a snapshot.
+	Sequence uint32
+
+	// The server tick of the world the client was rendering at the time.
+	Tick uint64
+
 	// We send the position to see if it matches how the server moved
 	// the player.
 	Position component.PositionData
@@ -51,6 +148,12 @@ type EventPlayerConnected struct {
 	Position   component.PositionData
 }
 
+// Message sent from the server to the clients to tell the clients that the
+// corresponding PlayerId has reconnected after its connection dropped.
+type EventPlayerReconnected struct {
+	PlayerId types.PlayerId
+}
+
 // Message sent from the server to the clients to tell the clients that the
 // corresponding PlayerId has disconnected
 type EventPlayerDisconnected struct {
@@ -68,10 +171,152 @@ type EventUpdateHealth struct {
 
 type EventPlayerDied struct {
 	PlayerId types.PlayerId // The player whose health is being updated
-	KilledBy types.PlayerId
+	KilledBy types.PlayerId // InvalidPlayerId when nobody is credited
 }
 
 type EventPlayerRespawned struct {
 	PlayerId types.PlayerId
 	Position component.PositionData
 }
+
+type PlayerSnapshot struct {
+	Player   component.PlayerData
+	Position component.PositionData
+}
+
+type BulletSnapshot struct {
+	Id       uint64 // The entity of the bullet in the server's world
+	FiredBy  types.PlayerId
+	Position component.PositionData
+}
+
+type ExplosionSnapshot struct {
+	Id       uint64 // The entity of the explosion in the server's world
+	Count    int
+	Position component.PositionData
+}
+
+// Message periodically sent from the server to the clients containing the
+// authoritative state of the world. The clients treat this as the ground
+// truth, the other events are only used as low-latency hints.
+type WorldSnapshot struct {
+	Tick       uint64
+	Players    []PlayerSnapshot
+	Bullets    []BulletSnapshot
+	Explosions []ExplosionSnapshot
+
+	// The sequence of the last move of the receiving client that the server
+	// processed and the tick when it was processed.
+	LastProcessedSequence uint32
+	LastProcessedTick     uint64
+}
+
+// Message sent from the client to the server to tell the server the tick of
+// the last snapshot that the client has applied.
+type AcknowledgeSnapshot struct {
+	Tick uint64
+}
+
+// Bit flags that mark which fields of a diff carry a value.
+const (
+	PositionX uint8 = 1 << iota
+	PositionY
+	PositionAngle
+)
+
+type PositionDiff struct {
+	Changed uint8
+	X       float64 `msgpack:",omitempty"`
+	Y       float64 `msgpack:",omitempty"`
+	Angle   float64 `msgpack:",omitempty"`
+}
+
+const (
+	PlayerName uint16 = 1 << iota
+	PlayerHealth
+	PlayerScore
+	PlayerIsAlive
+	PlayerIsConnected
+	PlayerIsRotatingClockwise
+	PlayerIsRotatingCounterClockwise
+	PlayerIsMovingForward
+	PlayerIsFiringBullet
+)
+
+type PlayerDiff struct {
+	Changed                    uint16
+	Name                       string  `msgpack:",omitempty"`
+	Health                     float64 `msgpack:",omitempty"`
+	Score                      int     `msgpack:",omitempty"`
+	IsAlive                    bool    `msgpack:",omitempty"`
+	IsConnected                bool    `msgpack:",omitempty"`
+	IsRotatingClockwise        bool    `msgpack:",omitempty"`
+	IsRotatingCounterClockwise bool    `msgpack:",omitempty"`
+	IsMovingForward            bool    `msgpack:",omitempty"`
+	IsFiringBullet             bool    `msgpack:",omitempty"`
+}
+
+type PlayerSnapshotDelta struct {
+	PlayerId types.PlayerId
+	Player   PlayerDiff
+	Position PositionDiff
+}
+
+type BulletSnapshotDelta struct {
+	Id       uint64
+	FiredBy  types.PlayerId
+	Position PositionDiff
+}
+
+// Message sent from the server to a client containing only what changed
+// between the snapshot that the client last acknowledged and the current one.
+type WorldSnapshotDelta struct {
+	Tick     uint64
+	BaseTick uint64
+
+	LastProcessedSequence uint32
+	LastProcessedTick     uint64
+
+	// Only the players and bullets that changed or are new.
+	Players []PlayerSnapshotDelta
+	Bullets []BulletSnapshotDelta
+	// Explosions do not move, so only the new ones are sent.
+	Explosions []ExplosionSnapshot
+
+	RemovedPlayers    []types.PlayerId
+	RemovedBullets    []uint64
+	RemovedExplosions []uint64
+}
+
+// Message periodically sent from the server to the clients to tell whether
+// the connection is still alive. It carries the latency measured so far.
+type Heartbeat struct {
+	// Increases with every heartbeat, echoed back as is.
+	Sequence uint32
+	// Time on the server when it was sent, echoed back as is. The server
+	// times the round trip with its own record of it.
+	SentAt int64
+
+	RoundTripTime time.Duration
+	Jitter        time.Duration
+}
+
+// Message sent from the client to the server as soon as a heartbeat arrives.
+type HeartbeatAck struct {
+	Sequence uint32
+	SentAt   int64
+}
+
+// Message sent from the server to the clients to show a message from the
+// operators of the server.
+type ServerAnnouncement struct {
+	Message string
+}
+
+// Message sent from the server to the clients when it is about to shut down.
+// Their connections are closed once the countdown is over.
+type ServerShuttingDown struct {
+	Reason string
+	// Zero when the server shuts down right away.
+	Countdown time.Duration
+}
@@ -0,0 +1,67 @@
+package messages
+
+import "fmt"
+
+// Version of the protocol spoken by this build. Bump it whenever a message
+// changes in a way that older builds can not understand.
+const ProtocolVersion = 2
+
+// Oldest version of the protocol that the server still accepts. Clients
+// within the window are answered in their own version.
+const MinProtocolVersion = 1
+
+// The last version whose envelope named the type of the message instead of
+// giving its id, and which had no batches.
+const LegacyProtocolVersion = 1
+
+// Optional features of the protocol, as bit flags.
+type Capabilities uint32
+
+const (
+	// The client can apply snapshots delta encoded against an acknowledged one.
+	CapabilityDeltaSnapshots Capabilities = 1 << iota
+	// The client answers heartbeats, and is dropped when it stops doing so.
+	CapabilityHeartbeat
+	// The client unpacks the messages of a tick sent together in one frame.
+	CapabilityBatching
+)
+
+// Everything this build supports.
+const SupportedCapabilities = CapabilityDeltaSnapshots | CapabilityHeartbeat | CapabilityBatching
+
+func (self Capabilities) Has(capability Capabilities) bool {
+	return self&capability == capability
+}
+
+// What is agreed on with a client speaking the given version and offering the
+// given capabilities.
+func NegotiateCapabilities(version int, offered Capabilities) Capabilities {
+	capabilities := offered & SupportedCapabilities
+	if version <= LegacyProtocolVersion {
+		capabilities &^= CapabilityBatching
+	}
+	return capabilities
+}
+
+// Tells whether a peer speaking the given version can be understood.
+func IsCompatibleVersion(version int) bool {
+	return version >= MinProtocolVersion && version <= ProtocolVersion
+}
+
+// The rejection shown to the player when the versions do not match.
+func NewVersionRejection(version int) HandshakeRejected {
+	expected := fmt.Sprintf("%d to %d", MinProtocolVersion, ProtocolVersion)
+	if MinProtocolVersion == ProtocolVersion {
+		expected = fmt.Sprint(ProtocolVersion)
+	}
+
+	message := fmt.Sprintf("The game is outdated (protocol %d, server expects %s), reload the page to update it", version, expected)
+	if version > ProtocolVersion {
+		message = fmt.Sprintf("The server is outdated (protocol %d, game uses %d)", ProtocolVersion, version)
+	}
+
+	return HandshakeRejected{
+		Reason:  RejectIncompatibleVersion,
+		Message: message,
+	}
+}
@@ -0,0 +1,54 @@
+package messages
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsCompatibleVersion(t *testing.T) {
+	tests := []struct {
+		version    int
+		compatible bool
+	}{
+		{0, false},
+		{MinProtocolVersion - 1, false},
+		{MinProtocolVersion, true},
+		{ProtocolVersion, true},
+		{ProtocolVersion + 1, false},
+	}
+
+	for _, test := range tests {
+		if compatible := IsCompatibleVersion(test.version); compatible != test.compatible {
+			t.Errorf("IsCompatibleVersion(%d) = %v, expected %v", test.version, compatible, test.compatible)
+		}
+	}
+}
+
+func TestNewVersionRejection(t *testing.T) {
+	tests := []struct {
+		version int
+		blames  string
+	}{
+		{MinProtocolVersion - 1, "The game is outdated"},
+		{ProtocolVersion + 1, "The server is outdated"},
+	}
+
+	for _, test := range tests {
+		rejection := NewVersionRejection(test.version)
+		if rejection.Reason != RejectIncompatibleVersion {
+			t.Errorf("Version %d rejected with the reason %d, expected %d", test.version, rejection.Reason, RejectIncompatibleVersion)
+		}
+		if !strings.HasPrefix(rejection.Message, test.blames) {
+			t.Errorf("Version %d rejected with %q, expected it to start with %q", test.version, rejection.Message, test.blames)
+		}
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	if capabilities := NegotiateCapabilities(LegacyProtocolVersion, SupportedCapabilities); capabilities.Has(CapabilityBatching) {
+		t.Errorf("Protocol %d got the capabilities %b, which has batching", LegacyProtocolVersion, capabilities)
+	}
+	if capabilities := NegotiateCapabilities(ProtocolVersion, SupportedCapabilities|1<<31); capabilities != SupportedCapabilities {
+		t.Errorf("Protocol %d got the capabilities %b, expected %b", ProtocolVersion, capabilities, SupportedCapabilities)
+	}
+}
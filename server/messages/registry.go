@@ -0,0 +1,40 @@
+package messages
+
+import "astro-blasters/rpc"
+
+// The ids are part of the protocol: never reuse or change one, only add new
+// ones and bump ProtocolVersion when removing any.
+func init() {
+	registry := rpc.DefaultRegistry()
+
+	rpc.Register[ConnectionHandshake](registry, 1)
+	rpc.Register[ConnectionHandshakeResponse](registry, 2)
+	rpc.Register[HandshakeRejected](registry, 3)
+	rpc.Register[Disconnected](registry, 4)
+
+	rpc.Register[ListRooms](registry, 10)
+	rpc.Register[ListRoomsResponse](registry, 11)
+	rpc.Register[CreateRoom](registry, 12)
+	rpc.Register[CreateRoomResponse](registry, 13)
+
+	rpc.Register[RegisterPlayerMove](registry, 20)
+	rpc.Register[AcknowledgeSnapshot](registry, 21)
+
+	rpc.Register[EventPlayerMove](registry, 30)
+	rpc.Register[EventPlayerConnected](registry, 31)
+	rpc.Register[EventPlayerReconnected](registry, 32)
+	rpc.Register[EventPlayerDisconnected](registry, 33)
+	rpc.Register[EventPlayerFireBullet](registry, 34)
+	rpc.Register[EventUpdateHealth](registry, 35)
+	rpc.Register[EventPlayerDied](registry, 36)
+	rpc.Register[EventPlayerRespawned](registry, 37)
+
+	rpc.Register[WorldSnapshot](registry, 40)
+	rpc.Register[WorldSnapshotDelta](registry, 41)
+
+	rpc.Register[Heartbeat](registry, 50)
+	rpc.Register[HeartbeatAck](registry, 51)
+
+	rpc.Register[ServerAnnouncement](registry, 70)
+	rpc.Register[ServerShuttingDown](registry, 71)
+}
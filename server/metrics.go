@@ -0,0 +1,239 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"astro-blasters/game/component"
+	"astro-blasters/rpc"
+
+	"github.com/yohamta/donburi"
+	"github.com/yohamta/donburi/filter"
+)
+
+// Upper bounds in seconds of the buckets of the tick duration histograms,
+// around the 16ms budget of a tick.
+var tickDurationBuckets = []float64{0.0005, 0.001, 0.002, 0.004, 0.008, 0.016, 0.032, 0.064}
+
+// The components whose entities are counted, by the name they are reported
+// with.
+var countedComponents = map[string]donburi.IComponentType{
+	"player":    component.Player,
+	"bullet":    component.Bullet,
+	"explosion": component.Explosion,
+}
+
+// What a room spent a tick on. The ticks broadcasting a snapshot are apart
+// from the ones simulating the world, which they would otherwise skew.
+const (
+	phaseSimulation = "simulation"
+	phaseBroadcast  = "broadcast"
+)
+
+// Why a message for a client was not sent.
+const (
+	dropQueueFull    = "queue_full"
+	dropSuperseded   = "superseded"
+	dropDisconnected = "disconnected"
+	dropWriteError   = "write_error"
+)
+
+// A counter for every value of a label.
+type counterVec struct {
+	mutex  sync.Mutex
+	values map[string]uint64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{values: make(map[string]uint64)}
+}
+
+func (self *counterVec) Add(label string, value uint64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.values[label] += value
+}
+
+func (self *counterVec) snapshot() map[string]uint64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	values := make(map[string]uint64, len(self.values))
+	for label, value := range self.values {
+		values[label] = value
+	}
+	return values
+}
+
+type histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (self *histogram) Observe(value float64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i, bound := range self.buckets {
+		if value <= bound {
+			self.counts[i] += 1
+		}
+	}
+	self.sum += value
+	self.count += 1
+}
+
+// What the server reports on /metrics, in the Prometheus text format.
+type serverMetrics struct {
+	// By phase.
+	tickDuration  map[string]*histogram
+	tickOverruns  atomic.Uint64
+	droppedSends  *counterVec
+	messagesSent  *counterVec
+	bytesSent     *counterVec
+	messagesRead  *counterVec
+	bytesReceived *counterVec
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		tickDuration: map[string]*histogram{
+			phaseSimulation: newHistogram(tickDurationBuckets),
+			phaseBroadcast:  newHistogram(tickDurationBuckets),
+		},
+		droppedSends:  newCounterVec(),
+		messagesSent:  newCounterVec(),
+		bytesSent:     newCounterVec(),
+		messagesRead:  newCounterVec(),
+		bytesReceived: newCounterVec(),
+	}
+}
+
+func (self *serverMetrics) ObserveTick(phase string, duration time.Duration, budget time.Duration) {
+	self.tickDuration[phase].Observe(duration.Seconds())
+	if duration > budget {
+		self.tickOverruns.Add(1)
+	}
+}
+
+func (self *serverMetrics) DropSend(reason string) {
+	self.droppedSends.Add(reason, 1)
+}
+
+func (self *serverMetrics) MessageSent(messageType rpc.MessageType, size int) {
+	self.messagesSent.Add(messageLabel(messageType), 1)
+	self.bytesSent.Add(messageLabel(messageType), uint64(size))
+}
+
+func (self *serverMetrics) MessageReceived(messageType rpc.MessageType, size int) {
+	self.messagesRead.Add(messageLabel(messageType), 1)
+	self.bytesReceived.Add(messageLabel(messageType), uint64(size))
+}
+
+// Name of the message type, the ids that are not registered share a single
+// label so that clients can not make up new series.
+func messageLabel(messageType rpc.MessageType) string {
+	if !rpc.IsRegistered(messageType) {
+		return "unknown"
+	}
+	return rpc.NameOf(messageType)
+}
+
+func (self *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	self.writeMetrics(w)
+}
+
+func (self *Server) writeMetrics(w io.Writer) {
+	metrics := self.metrics
+	rooms := self.rooms.All()
+
+	writeHeader(w, "astro_rooms", "gauge", "Number of open rooms.")
+	fmt.Fprintf(w, "astro_rooms %d\n", len(rooms))
+
+	writeHeader(w, "astro_connected_players", "gauge", "Number of players connected to a room.")
+	for _, room := range rooms {
+		fmt.Fprintf(w, "astro_connected_players{room=%q} %d\n", room.code, room.ConnectedPlayers())
+	}
+
+	writeHeader(w, "astro_entities", "gauge", "Number of entities of a room with the component.")
+	for _, room := range rooms {
+		counts := room.CountEntities()
+		for _, name := range sortedKeys(counts) {
+			fmt.Fprintf(w, "astro_entities{room=%q,component=%q} %d\n", room.code, name, counts[name])
+		}
+	}
+
+	writeHeader(w, "astro_tick_duration_seconds", "histogram", "Time spent on a tick of a room by phase, simulating the world or broadcasting a snapshot, including sending the messages.")
+	for _, phase := range sortedKeys(metrics.tickDuration) {
+		histogram := metrics.tickDuration[phase]
+		histogram.mutex.Lock()
+		for i, bound := range histogram.buckets {
+			fmt.Fprintf(w, "astro_tick_duration_seconds_bucket{phase=%q,le=%q} %d\n", phase, formatFloat(bound), histogram.counts[i])
+		}
+		fmt.Fprintf(w, "astro_tick_duration_seconds_bucket{phase=%q,le=\"+Inf\"} %d\n", phase, histogram.count)
+		fmt.Fprintf(w, "astro_tick_duration_seconds_sum{phase=%q} %s\n", phase, formatFloat(histogram.sum))
+		fmt.Fprintf(w, "astro_tick_duration_seconds_count{phase=%q} %d\n", phase, histogram.count)
+		histogram.mutex.Unlock()
+	}
+
+	writeHeader(w, "astro_tick_overruns_total", "counter", "Number of ticks that took longer than their budget.")
+	fmt.Fprintf(w, "astro_tick_overruns_total %d\n", metrics.tickOverruns.Load())
+
+	writeCounterVec(w, "astro_messages_sent_total", "Number of messages sent to the clients.", "type", metrics.messagesSent)
+	writeCounterVec(w, "astro_bytes_sent_total", "Bytes sent to the clients, the envelopes of batches are counted as Batch.", "type", metrics.bytesSent)
+	writeCounterVec(w, "astro_messages_received_total", "Number of messages received from the clients.", "type", metrics.messagesRead)
+	writeCounterVec(w, "astro_bytes_received_total", "Bytes received from the clients.", "type", metrics.bytesReceived)
+	writeCounterVec(w, "astro_dropped_sends_total", "Number of messages for the clients that were not sent.", "reason", metrics.droppedSends)
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounterVec(w io.Writer, name string, help string, label string, counter *counterVec) {
+	writeHeader(w, name, "counter", help)
+	values := counter.snapshot()
+	for _, value := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, value, values[value])
+	}
+}
+
+func sortedKeys[Value any](values map[string]Value) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Counts the entities of the simulation with each counted component, as of
+// the next tick.
+func (self *Room) CountEntities() map[string]int {
+	counts := make(map[string]int, len(countedComponents))
+	self.execute(func() {
+		for name, componentType := range countedComponents {
+			counts[name] = donburi.NewQuery(filter.Contains(componentType)).Count(self.simulation.ECS.World)
+		}
+	})
+	return counts
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"astro-blasters/game"
+	"astro-blasters/rpc"
+	"astro-blasters/server/messages"
+)
+
+func TestUnknownMessagesShareLabel(t *testing.T) {
+	metrics := newServerMetrics()
+	metrics.MessageReceived(rpc.TypeOf[messages.HeartbeatAck](), 10)
+	for messageType := range rpc.MessageType(100) {
+		metrics.MessageReceived(50000+messageType, 10)
+	}
+
+	received := metrics.messagesRead.snapshot()
+	if len(received) != 2 || received["HeartbeatAck"] != 1 || received["unknown"] != 100 {
+		t.Errorf("Got the labels %v, expected HeartbeatAck and unknown", received)
+	}
+}
+
+func TestTickPhasesHaveTheirOwnHistograms(t *testing.T) {
+	metrics := newServerMetrics()
+	metrics.ObserveTick(phaseSimulation, time.Millisecond, game.TickDuration)
+	metrics.ObserveTick(phaseBroadcast, time.Millisecond, game.TickDuration)
+	metrics.ObserveTick(phaseBroadcast, time.Millisecond, game.TickDuration)
+
+	if count := metrics.tickDuration[phaseSimulation].count; count != 1 {
+		t.Errorf("Got %d simulated ticks, expected 1", count)
+	}
+	if count := metrics.tickDuration[phaseBroadcast].count; count != 2 {
+		t.Errorf("Got %d broadcasting ticks, expected 2", count)
+	}
+}
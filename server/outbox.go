@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"astro-blasters/rpc"
+)
+
+// Returned when a client reads its messages slower than they are produced.
+var ErrOutboxFull = errors.New("Too many messages waiting to be sent")
+
+// How long writing a single message to a client may take.
+const writeTimeout = time.Second
+
+type outboxEntry struct {
+	message rpc.BaseMessage
+	// Only the latest snapshot is worth sending, the older ones still
+	// waiting are dropped when a new one comes in.
+	isSnapshot bool
+	// Closed once the message has been written, when not nil.
+	written chan struct{}
+}
+
+// Ordered queue of the messages waiting to be written to a connection. A
+// single goroutine writes them, so the client gets them in order and a slow
+// client can not pile up goroutines on the server. The messages are only
+// written once flushed, which the room does after every tick.
+type outbox struct {
+	mutex    sync.Mutex
+	capacity int
+	metrics  *serverMetrics
+	entries  []outboxEntry
+	closed   bool
+	// Signaled when the entries are flushed.
+	wake chan struct{}
+}
+
+func newOutbox(capacity int, metrics *serverMetrics) *outbox {
+	return &outbox{
+		capacity: capacity,
+		metrics:  metrics,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Queues the message, coalescing the pending snapshots. Fails when the queue
+// is still full afterwards, at which point the client can not catch up.
+func (self *outbox) Push(entry outboxEntry) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return nil
+	}
+
+	if entry.isSnapshot {
+		pending := self.entries[:0]
+		for _, queued := range self.entries {
+			if !queued.isSnapshot {
+				pending = append(pending, queued)
+			}
+		}
+		if superseded := len(self.entries) - len(pending); superseded > 0 {
+			self.metrics.droppedSends.Add(dropSuperseded, uint64(superseded))
+		}
+		clear(self.entries[len(pending):])
+		self.entries = pending
+	}
+
+	if len(self.entries) >= self.capacity {
+		return ErrOutboxFull
+	}
+	self.entries = append(self.entries, entry)
+	return nil
+}
+
+// Lets the writer send everything queued so far.
+func (self *outbox) Flush() {
+	select {
+	case self.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Writes the flushed messages to the connection until the context is done or
+// a write fails. When batching, the messages flushed together are written as
+// a single frame.
+func (self *outbox) Run(ctx context.Context, connection rpc.Transport, batching bool) error {
+	defer self.close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-self.wake:
+		}
+
+		entries := self.take()
+		if err := self.write(ctx, connection, entries, batching); err != nil {
+			self.metrics.DropSend(dropWriteError)
+			// The connection is going away anyway.
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.written != nil {
+				close(entry.written)
+			}
+		}
+	}
+}
+
+func (self *outbox) write(ctx context.Context, connection rpc.Transport, entries []outboxEntry, batching bool) error {
+	if batching && len(entries) > 1 {
+		messages := make([]rpc.BaseMessage, len(entries))
+		for i, entry := range entries {
+			messages[i] = entry.message
+		}
+
+		writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+		defer cancel()
+		return rpc.WriteBatch(writeCtx, connection, messages)
+	}
+
+	for _, entry := range entries {
+		writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+		err := rpc.WriteMessage(writeCtx, connection, entry.message)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *outbox) take() []outboxEntry {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	entries := self.entries
+	self.entries = nil
+	return entries
+}
+
+func (self *outbox) close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.closed = true
+	self.entries = nil
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"astro-blasters/rpc"
+	"astro-blasters/server/config"
+	"astro-blasters/server/messages"
+)
+
+// Returned for a message over the rate limit of its kind, it is dropped.
+var ErrRateLimited = errors.New("Rate limit exceeded")
+
+// Returned once a client went over the rate limits too often.
+var ErrTooManyViolations = errors.New("Too many messages over the rate limits")
+
+// Holds up to a burst of tokens and refills at a steady rate. Every message
+// takes a token.
+type tokenBucket struct {
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newTokenBucket(limit config.RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:       limit.Rate,
+		burst:      float64(limit.Burst),
+		tokens:     float64(limit.Burst),
+		lastRefill: now,
+	}
+}
+
+func (self *tokenBucket) Take(now time.Time) bool {
+	self.tokens = min(self.burst, self.tokens+now.Sub(self.lastRefill).Seconds()*self.rate)
+	self.lastRefill = now
+
+	if self.tokens < 1 {
+		return false
+	}
+	self.tokens -= 1
+	return true
+}
+
+// Tells whether the bucket would be full by now, in which case forgetting it
+// changes nothing.
+func (self *tokenBucket) IsFull(now time.Time) bool {
+	return self.tokens+now.Sub(self.lastRefill).Seconds()*self.rate >= self.burst
+}
+
+// How many addresses the lobby limiter tracks before forgetting the ones that
+// went quiet.
+const maxTrackedAddresses = 1024
+
+// Applies a rate limit to each address rather than each connection, for the
+// lobby which opens a connection per request.
+type addressLimiter struct {
+	mutex   sync.Mutex
+	limit   config.RateLimit
+	buckets map[string]*tokenBucket
+}
+
+func newAddressLimiter(limit config.RateLimit) *addressLimiter {
+	return &addressLimiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Takes a token for a request from the address, the port does not count.
+func (self *addressLimiter) Allow(address string) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := time.Now()
+	if len(self.buckets) >= maxTrackedAddresses {
+		for host, bucket := range self.buckets {
+			if bucket.IsFull(now) {
+				delete(self.buckets, host)
+			}
+		}
+	}
+
+	host := banHost(address)
+	bucket, ok := self.buckets[host]
+	if !ok {
+		bucket = newTokenBucket(self.limit, now)
+		self.buckets[host] = bucket
+	}
+	return bucket.Take(now)
+}
+
+// Applies the rate limits to the messages of a single connection. Only used
+// by the goroutine reading the connection.
+type rateLimiter struct {
+	config  *config.ServerConfig
+	buckets map[rpc.MessageType]*tokenBucket
+	// Shared by the types that are not registered, so that making up types
+	// does not grow the buckets.
+	unknown *tokenBucket
+
+	violations      int
+	violationsSince time.Time
+}
+
+func newRateLimiter(config *config.ServerConfig) *rateLimiter {
+	now := time.Now()
+	return &rateLimiter{
+		config: config,
+		buckets: map[rpc.MessageType]*tokenBucket{
+			rpc.TypeOf[messages.RegisterPlayerMove]():  newTokenBucket(config.MoveRateLimit, now),
+			rpc.TypeOf[messages.AcknowledgeSnapshot](): newTokenBucket(config.AcknowledgeRateLimit, now),
+			rpc.TypeOf[messages.HeartbeatAck]():        newTokenBucket(config.HeartbeatAckRateLimit, now),
+		},
+		unknown:         newTokenBucket(config.DefaultRateLimit, now),
+		violationsSince: now,
+	}
+}
+
+// Takes a token for the message. Fails with ErrRateLimited when there is
+// none left, or ErrTooManyViolations when that happened too often lately.
+func (self *rateLimiter) Allow(messageType rpc.MessageType) error {
+	now := time.Now()
+
+	bucket, ok := self.buckets[messageType]
+	if !rpc.IsRegistered(messageType) {
+		bucket = self.unknown
+	} else if !ok {
+		bucket = newTokenBucket(self.config.DefaultRateLimit, now)
+		self.buckets[messageType] = bucket
+	}
+	if bucket.Take(now) {
+		return nil
+	}
+	return self.violation(now)
+}
+
+// Counts a message that the client should not have sent, such as one of an
+// unknown type. Fails like Allow.
+func (self *rateLimiter) Violation() error {
+	return self.violation(time.Now())
+}
+
+func (self *rateLimiter) violation(now time.Time) error {
+	if now.Sub(self.violationsSince) > self.config.RateViolationWindow {
+		self.violations = 0
+		self.violationsSince = now
+	}
+	self.violations += 1
+
+	if self.violations > self.config.MaxRateViolations {
+		return ErrTooManyViolations
+	}
+	return ErrRateLimited
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"astro-blasters/rpc"
+	"astro-blasters/server/config"
+	"astro-blasters/server/messages"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(config.RateLimit{Rate: 10, Burst: 3}, now)
+
+	for i := range 3 {
+		if !bucket.Take(now) {
+			t.Fatalf("The burst ran out after %d tokens, expected 3", i)
+		}
+	}
+	if bucket.Take(now) {
+		t.Error("Took a token past the burst")
+	}
+
+	// A token every 100ms.
+	if bucket.Take(now.Add(50 * time.Millisecond)) {
+		t.Error("Took a token before it was refilled")
+	}
+	if !bucket.Take(now.Add(150 * time.Millisecond)) {
+		t.Error("The bucket did not refill")
+	}
+	if bucket.IsFull(now.Add(200 * time.Millisecond)) {
+		t.Error("The bucket was full before refilling the burst")
+	}
+
+	// Refilling stops at the burst.
+	later := now.Add(time.Hour)
+	if !bucket.IsFull(later) {
+		t.Error("The bucket was not full after an hour")
+	}
+	for i := range 3 {
+		if !bucket.Take(later) {
+			t.Fatalf("The burst ran out after %d tokens, expected 3", i)
+		}
+	}
+	if bucket.Take(later) {
+		t.Error("The bucket refilled past the burst")
+	}
+}
+
+func TestRateLimiterViolations(t *testing.T) {
+	config := newTestConfig()
+	config.DefaultRateLimit = config.HeartbeatAckRateLimit
+	config.MaxRateViolations = 2
+	limiter := newRateLimiter(config)
+
+	ack := rpc.TypeOf[messages.HeartbeatAck]()
+	for range config.HeartbeatAckRateLimit.Burst {
+		if err := limiter.Allow(ack); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []error{ErrRateLimited, ErrRateLimited, ErrTooManyViolations}
+	for _, expected := range expected {
+		if err := limiter.Allow(ack); !errors.Is(err, expected) {
+			t.Errorf("Got %v, expected %v", err, expected)
+		}
+	}
+}
+
+func TestRateLimiterSharesUnknownBucket(t *testing.T) {
+	limiter := newRateLimiter(newTestConfig())
+
+	for messageType := range rpc.MessageType(100) {
+		limiter.Allow(50000 + messageType)
+	}
+	if len(limiter.buckets) != 3 {
+		t.Errorf("Got %d buckets, expected the unknown types to share one", len(limiter.buckets))
+	}
+	if err := limiter.Allow(50000); err == nil {
+		t.Error("The unknown types got a bucket each")
+	}
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"astro-blasters/server/messages"
+	"log/slog"
+	"runtime/debug"
+)
+
+// Sent to the clients whose connection or room panicked.
+var serverErrorDisconnect = messages.Disconnected{
+	Reason:  messages.DisconnectServerError,
+	Message: "The server failed to handle your connection",
+}
+
+// Logs a panic recovered by a deferred function, along with the stack of the
+// goroutine that panicked.
+func logPanic(logger *slog.Logger, recovered any) {
+	logger.Error("Recovered from a panic", "panic", recovered, "stack", string(debug.Stack()))
+}
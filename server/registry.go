@@ -0,0 +1,120 @@
+package server
+
+import (
+	"astro-blasters/game/types"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrRoomFull = errors.New("The room is full")
+
+// Hands out the ids of the players in a room and keeps track of their
+// connections. The ids of players that left are reused by the next ones.
+type playerRegistry struct {
+	mutex       sync.RWMutex
+	maxPlayers  int
+	connections map[types.PlayerId]*playerConnection
+
+	freeIds []types.PlayerId
+	nextId  types.PlayerId
+
+	// Increases with every registration, so that a session of a player that
+	// left can not take over the ship of whoever got its id afterwards.
+	nextSession uint64
+}
+
+func newPlayerRegistry(maxPlayers int) *playerRegistry {
+	return &playerRegistry{
+		maxPlayers:  maxPlayers,
+		connections: make(map[types.PlayerId]*playerConnection),
+	}
+}
+
+func (self *playerRegistry) Register(playerConn *playerConnection) (types.PlayerId, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if len(self.connections) >= self.maxPlayers {
+		return types.InvalidPlayerId, ErrRoomFull
+	}
+
+	var playerId types.PlayerId
+	if len(self.freeIds) > 0 {
+		playerId = self.freeIds[0]
+		self.freeIds = self.freeIds[1:]
+	} else {
+		playerId = self.nextId
+		self.nextId += 1
+	}
+
+	self.nextSession += 1
+	playerConn.session = self.nextSession
+	self.connections[playerId] = playerConn
+	return playerId, nil
+}
+
+func (self *playerRegistry) Get(playerId types.PlayerId) *playerConnection {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	return self.connections[playerId]
+}
+
+func (self *playerRegistry) Release(playerId types.PlayerId) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if _, ok := self.connections[playerId]; !ok {
+		return
+	}
+
+	delete(self.connections, playerId)
+	self.freeIds = append(self.freeIds, playerId)
+	// Hand out the lowest ids first to keep them small.
+	sort.Slice(self.freeIds, func(i, j int) bool {
+		return self.freeIds[i] < self.freeIds[j]
+	})
+}
+
+func (self *playerRegistry) Connected() int {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	count := 0
+	for _, playerConn := range self.connections {
+		playerConn.mutex.Lock()
+		if playerConn.isConnected {
+			count += 1
+		}
+		playerConn.mutex.Unlock()
+	}
+	return count
+}
+
+// Calls the function for every registered player, connected or not.
+func (self *playerRegistry) Each(fn func(playerId types.PlayerId, playerConn *playerConnection)) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	for playerId, playerConn := range self.connections {
+		fn(playerId, playerConn)
+	}
+}
+
+// Returns the players that have been disconnected for longer than the timeout.
+func (self *playerRegistry) Stale(timeout time.Duration) []types.PlayerId {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	stale := []types.PlayerId{}
+	for playerId, playerConn := range self.connections {
+		playerConn.mutex.Lock()
+		if !playerConn.isConnected && time.Since(playerConn.disconnectedAt) > timeout {
+			stale = append(stale, playerId)
+		}
+		playerConn.mutex.Unlock()
+	}
+	return stale
+}
@@ -0,0 +1,847 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"astro-blasters/game"
+	"astro-blasters/game/component"
+	"astro-blasters/game/types"
+	"astro-blasters/rpc"
+	"astro-blasters/server/anticheat"
+	"astro-blasters/server/config"
+	"astro-blasters/server/messages"
+	"log/slog"
+	"math/rand"
+
+	"github.com/yohamta/donburi"
+	"github.com/yohamta/donburi/filter"
+)
+
+const (
+	// How many commands can wait for the next tick before their senders block.
+	commandQueueSize = 256
+
+	respawnDelay = 5 * time.Second
+)
+
+// An independent arena with its own simulation and players.
+type Room struct {
+	code       string
+	config     *config.ServerConfig
+	simulation *game.GameSimulation
+	sessions   *sessionSigner
+	bans       *banList
+	metrics    *serverMetrics
+	logger     *slog.Logger
+
+	players   *playerRegistry
+	snapshots []messages.WorldSnapshot
+
+	// Every change to the simulation goes through this queue, which is drained
+	// by the goroutine running the room so that the world has a single writer.
+	commands chan func()
+	// Closed once the room stopped running, after which commands are dropped.
+	stopped  chan struct{}
+	respawns []scheduledRespawn
+	// Set to close the room once the current tick is over.
+	closing *messages.Disconnected
+
+	// When the last player left the room.
+	emptySince time.Time
+}
+
+// A dead player that comes back at the given tick.
+type scheduledRespawn struct {
+	playerId types.PlayerId
+	tick     uint64
+}
+
+// The outcome of letting a player into the room.
+type admission struct {
+	playerId     types.PlayerId
+	response     messages.ConnectionHandshakeResponse
+	announcement rpc.BaseMessage
+}
+
+type playerConnection struct {
+	mutex   sync.Mutex
+	session uint64
+	conn    rpc.Transport
+	// Logs with the context of the player and its connection.
+	logger *slog.Logger
+	// What was agreed on with the client during the handshake.
+	protocolVersion int
+	capabilities    messages.Capabilities
+
+	isConnected    bool
+	disconnectedAt time.Time
+	// The tick at which the player last fired, zero if it never did.
+	lastBulletFire uint64
+
+	// The tick of the last snapshot that the client applied.
+	lastAcknowledgedTick atomic.Uint64
+	// Set when the client has to be sent the whole world, whatever it
+	// acknowledged, to correct where it thinks it is.
+	needsFullSnapshot atomic.Bool
+
+	// The sequence of the last move of the client and the tick at which it
+	// was applied to the simulation.
+	lastProcessedSequence atomic.Uint32
+	lastProcessedTick     atomic.Uint64
+
+	latency latencyEstimator
+	cheats  *anticheat.Tracker
+	// Replaced along with the connection when the player reconnects.
+	outbox *outbox
+}
+
+func (self *playerConnection) flush() {
+	self.mutex.Lock()
+	outbox := self.outbox
+	self.mutex.Unlock()
+
+	outbox.Flush()
+}
+
+func (self *playerConnection) Logger() *slog.Logger {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.logger
+}
+
+func NewRoom(code string, config *config.ServerConfig, sessions *sessionSigner, bans *banList, metrics *serverMetrics) *Room {
+	r := &Room{
+		code:       code,
+		config:     config,
+		sessions:   sessions,
+		bans:       bans,
+		metrics:    metrics,
+		logger:     slog.Default().With("room", code),
+		players:    newPlayerRegistry(config.MaxPlayers),
+		commands:   make(chan func(), commandQueueSize),
+		stopped:    make(chan struct{}),
+		emptySince: time.Now(),
+	}
+
+	seed := rand.Int63()
+	r.logger.Info("Room created", "seed", seed)
+
+	r.simulation = game.NewGameSimulation(game.SystemClock, seed)
+	r.simulation.SetRewindWindow(config.LagCompensationWindow)
+
+	r.simulation.OnBulletCollide = r.onBulletCollide
+	r.simulation.OnBulletFire = r.onBulletFire
+	return r
+}
+
+func (self *Room) onBulletFire(player *donburi.Entry) {
+	playerId := component.Player.Get(player).Id
+	connection := self.players.Get(playerId)
+	now := self.simulation.Tick
+
+	if connection.lastBulletFire == 0 || now-connection.lastBulletFire >= game.DurationToTicks(self.config.FireCooldown) {
+		connection.lastBulletFire = now
+		self.broadcastMessage(rpc.NewBaseMessage(messages.EventPlayerFireBullet{
+			PlayerId: playerId,
+		}))
+		self.simulation.RegisterPlayerFire(player)
+	}
+}
+
+func (self *Room) onBulletCollide(player *donburi.Entry, bullet *donburi.Entry) {
+	playerData := component.Player.Get(player)
+	playerData.Health -= game.PlayerDamagePerHit
+
+	if playerData.Health > 0 {
+		self.broadcastMessage(rpc.NewBaseMessage(messages.EventUpdateHealth{
+			PlayerId: playerData.Id,
+			Health:   playerData.Health,
+		}))
+	} else if playerData.Health == 0 {
+		bulletData := component.Bullet.Get(bullet)
+		// The shooter may have been evicted while its bullet was flying.
+		scorer := self.simulation.FindCorrespondingPlayer(bulletData.FiredBy)
+
+		killedBy := types.InvalidPlayerId
+		if scorer != nil {
+			killedBy = component.Player.Get(scorer).Id
+		}
+
+		self.broadcastMessage(rpc.NewBaseMessage(messages.EventPlayerDied{
+			PlayerId: playerData.Id,
+			KilledBy: killedBy,
+		}))
+
+		self.simulation.RegisterPlayerDeath(player, scorer)
+
+		self.respawns = append(self.respawns, scheduledRespawn{
+			playerId: playerData.Id,
+			tick:     self.simulation.Tick + game.DurationToTicks(respawnDelay),
+		})
+	}
+}
+
+// Brings back the dead players whose respawn is due.
+func (self *Room) respawnPlayers() {
+	pending := self.respawns[:0]
+	for _, respawn := range self.respawns {
+		if respawn.tick > self.simulation.Tick {
+			pending = append(pending, respawn)
+			continue
+		}
+
+		// The player might have been evicted in the meantime.
+		player := self.simulation.FindCorrespondingPlayer(respawn.playerId)
+		if player == nil {
+			continue
+		}
+
+		position := self.simulation.GenerateRandomPlayerPosition()
+		self.simulation.RespawnPlayer(player, position)
+
+		self.broadcastMessage(rpc.NewBaseMessage(messages.EventPlayerRespawned{
+			PlayerId: respawn.playerId,
+			Position: position,
+		}))
+	}
+	self.respawns = pending
+}
+
+func (self *Room) handleConnection(ctx context.Context, connection rpc.Transport, connectionHandshake messages.ConnectionHandshake, session *sessionClaims) error {
+	// Register the connected player.
+	playerId, err := self.establishConnection(ctx, connection, connectionHandshake, session)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		connection.Close()
+		self.enqueue(func() {
+			self.disconnectPlayer(playerId, connection)
+		})
+	}()
+
+	playerConn := self.players.Get(playerId)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Only started now so that the handshake response is the first message
+	// the client gets.
+	// A reconnection of the same player replaces these under the lock.
+	playerConn.mutex.Lock()
+	outbox, logger, capabilities := playerConn.outbox, playerConn.logger, playerConn.capabilities
+	playerConn.mutex.Unlock()
+	batching := capabilities.Has(messages.CapabilityBatching)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				logPanic(logger, recovered)
+				connection.Close()
+			}
+		}()
+		if err := outbox.Run(ctx, connection, batching); err != nil {
+			logger.Warn("Failed to send a message", "error", err)
+			connection.Close()
+		}
+	}()
+
+	logger.Info("Player connected")
+	defer logger.Info("Player disconnected")
+
+	// A bug triggered by a single client only costs it its connection, which
+	// is still open at this point to tell it why.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logPanic(logger, recovered)
+			self.dropConnection(context.Background(), logger, connection, serverErrorDisconnect)
+		}
+	}()
+
+	if capabilities.Has(messages.CapabilityHeartbeat) {
+		go self.sendHeartbeats(ctx, playerId, playerConn, connection)
+	}
+
+	router := rpc.NewRouter()
+	rpc.Handle(router, func(registerPlayerMove messages.RegisterPlayerMove) error {
+		self.enqueue(func() {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					logPanic(logger, recovered)
+					go self.kickPlayer(logger, connection, serverErrorDisconnect)
+				}
+			}()
+
+			if !self.checkMove(playerId, playerConn, connection, registerPlayerMove) {
+				return
+			}
+
+			self.simulation.RegisterPlayerView(playerId, registerPlayerMove.Tick)
+			if err := self.simulation.RegisterPlayerMove(playerId, registerPlayerMove.Move); err != nil {
+				logger.Warn("Invalid move", "error", err)
+				return
+			}
+
+			playerConn.lastProcessedSequence.Store(registerPlayerMove.Sequence)
+			playerConn.lastProcessedTick.Store(self.simulation.Tick)
+
+			self.broadcastMessage(rpc.NewBaseMessage(messages.EventPlayerMove{
+				Move:     registerPlayerMove.Move,
+				PlayerId: playerId,
+			}))
+		})
+		return nil
+	})
+	rpc.Handle(router, func(heartbeatAck messages.HeartbeatAck) error {
+		if !playerConn.latency.Acknowledge(heartbeatAck.Sequence, heartbeatAck.SentAt, time.Now(), self.heartbeatTimeout()) {
+			logger.Debug("Ignored a heartbeat answer", "sequence", heartbeatAck.Sequence)
+		}
+		return nil
+	})
+	rpc.Handle(router, func(acknowledgeSnapshot messages.AcknowledgeSnapshot) error {
+		// The connection being replaced may still be acknowledging too.
+		for {
+			acknowledged := playerConn.lastAcknowledgedTick.Load()
+			if acknowledgeSnapshot.Tick <= acknowledged || playerConn.lastAcknowledgedTick.CompareAndSwap(acknowledged, acknowledgeSnapshot.Tick) {
+				return nil
+			}
+		}
+	})
+
+	limiter := newRateLimiter(self.config)
+	router.Filter(func(message rpc.BaseMessage) error {
+		return limiter.Allow(message.MessageType)
+	})
+
+	for {
+		var message rpc.BaseMessage
+		err := rpc.ReceiveMessage(ctx, connection, &message)
+		if errors.Is(err, rpc.ErrMessageTooLarge) {
+			self.dropConnection(ctx, logger, connection, messages.Disconnected{
+				Reason:  messages.DisconnectMessageTooLarge,
+				Message: fmt.Sprintf("You sent a message over the limit of %d bytes", self.config.MaxMessageSize),
+			})
+			break
+		}
+		if err == nil {
+			err = router.Dispatch(message)
+		} else if !errors.Is(err, rpc.ErrMalformedMessage) {
+			// The connection is gone, there is nobody left to tell.
+			logger.Debug("Stopped reading the connection", "error", err)
+			break
+		}
+
+		// Skipped, the next frame might be fine.
+		if errors.Is(err, rpc.ErrMalformedMessage) || errors.Is(err, rpc.ErrUnknownMessage) ||
+			errors.Is(err, rpc.ErrUnexpectedMessage) || errors.Is(err, rpc.ErrNestedBatch) {
+			logger.Debug("Invalid message", "error", err)
+			err = limiter.Violation()
+		}
+		if errors.Is(err, ErrTooManyViolations) {
+			self.dropConnection(ctx, logger, connection, messages.Disconnected{
+				Reason:  messages.DisconnectRateLimited,
+				Message: "You sent too many messages",
+			})
+			break
+		}
+	}
+	return nil
+}
+
+// Runs the anti-cheat checks on the move before it is applied, and punishes
+// the player when it cheated too often. Returns whether the move can be
+// applied. Runs on the goroutine of the room.
+func (self *Room) checkMove(playerId types.PlayerId, playerConn *playerConnection, connection rpc.Transport, move messages.RegisterPlayerMove) bool {
+	player := self.simulation.FindCorrespondingPlayer(playerId)
+	if player == nil {
+		return false
+	}
+
+	roundTripTime, _ := playerConn.latency.Get()
+	now := time.Now()
+	violations := playerConn.cheats.CheckMove(move, component.Player.Get(player), component.Position.GetValue(player), roundTripTime, now)
+	if len(violations) == 0 {
+		return true
+	}
+
+	logger := playerConn.Logger()
+	logger.Warn("Suspicious move", "violations", violations)
+
+	switch playerConn.cheats.Record(violations, now) {
+	case anticheat.ActionKick:
+		go self.kickPlayer(logger, connection, messages.Disconnected{
+			Reason:  messages.DisconnectCheating,
+			Message: "You were kicked for cheating",
+		})
+		return false
+	case anticheat.ActionBan:
+		duration := self.config.AntiCheat.BanDuration
+		ban := Ban{
+			Address: connection.RemoteAddr(),
+			Until:   now.Add(duration),
+			Reason:  "Cheating",
+		}
+		// Saving the bans writes to the disk, which the tick can not wait for.
+		// The player is only kicked once banned so it can not come back.
+		go func() {
+			if err := self.bans.Add(ban); err != nil {
+				logger.Error("Failed to save the ban", "error", err)
+			}
+			self.kickPlayer(logger, connection, messages.Disconnected{
+				Reason:  messages.DisconnectBanned,
+				Message: fmt.Sprintf("You were banned for %s for cheating", duration),
+			})
+		}()
+		return false
+	}
+
+	for _, violation := range violations {
+		if !violation.IsCorrectable() {
+			return false
+		}
+	}
+
+	// The client goes back to where the server has it with the next full
+	// snapshot.
+	playerConn.needsFullSnapshot.Store(true)
+	return true
+}
+
+func (self *Room) kickPlayer(logger *slog.Logger, connection rpc.Transport, disconnected messages.Disconnected) {
+	self.dropConnection(context.Background(), logger, connection, disconnected)
+	connection.Close()
+}
+
+// Tells the client why it is dropped, the connection is closed by its caller
+// afterwards.
+func (self *Room) dropConnection(ctx context.Context, logger *slog.Logger, connection rpc.Transport, disconnected messages.Disconnected) {
+	logger.Info("Disconnecting the player", "reason", disconnected.Message)
+
+	// Written right away rather than queued, as the connection is about to
+	// be closed.
+	ctx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+	rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(disconnected))
+}
+
+// Queues a change to the simulation, which is applied at the start of the
+// next tick. Returns false when the room is not running anymore.
+func (self *Room) enqueue(command func()) bool {
+	select {
+	case self.commands <- command:
+		return true
+	case <-self.stopped:
+		return false
+	}
+}
+
+// Queues a change to the simulation and waits until it has been applied.
+// Returns false when the room is not running anymore or the command panicked.
+func (self *Room) execute(command func()) bool {
+	done := make(chan struct{})
+	completed := false
+	if !self.enqueue(func() {
+		defer close(done)
+		command()
+		completed = true
+	}) {
+		return false
+	}
+
+	select {
+	case <-done:
+		return completed
+	case <-self.stopped:
+		select {
+		case <-done:
+			return completed
+		default:
+			return false
+		}
+	}
+}
+
+// Applies the commands queued since the last tick. Commands queued meanwhile
+// wait for the next one, so a busy room can not stall the simulation.
+func (self *Room) runCommands() {
+	for pending := len(self.commands); pending > 0; pending-- {
+		self.runCommand(<-self.commands)
+	}
+}
+
+// Runs the command, dropping it when it panics so that the others still run.
+func (self *Room) runCommand(command func()) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logPanic(self.logger, recovered)
+		}
+	}()
+
+	command()
+}
+
+// Runs the simulation of the room until it has been empty for too long. This
+// is the only goroutine that touches the simulation.
+func (self *Room) updateState(isIdle func(room *Room) bool) {
+	defer close(self.stopped)
+	// The simulation can not be trusted anymore after a panic, so the room is
+	// closed but the rest of the server keeps running.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logPanic(self.logger, recovered)
+			self.closeConnections(serverErrorDisconnect)
+		}
+	}()
+
+	ticker := time.NewTicker(game.TickDuration)
+	defer ticker.Stop()
+
+	snapshotTicker := time.NewTicker(time.Second / time.Duration(self.config.SnapshotRate))
+	defer snapshotTicker.Stop()
+
+	for {
+		var start time.Time
+		var phase string
+		select {
+		case <-ticker.C:
+			start, phase = time.Now(), phaseSimulation
+			self.runCommands()
+			self.simulation.Advance()
+			self.respawnPlayers()
+		case <-snapshotTicker.C:
+			start, phase = time.Now(), phaseBroadcast
+			if isIdle(self) {
+				return
+			}
+			self.evictStalePlayers()
+			self.broadcastSnapshot()
+		}
+		// Sending the messages takes from the budget of the tick as much as
+		// the rest.
+		self.flushMessages()
+		self.metrics.ObserveTick(phase, time.Since(start), game.TickDuration)
+
+		if self.closing != nil {
+			self.drainConnections(*self.closing)
+			self.logger.Info("Room closed", "reason", self.closing.Message)
+			return
+		}
+	}
+}
+
+// Closes the room at the end of the current tick, the connected players are
+// told why once they got everything queued for them. Does not wait for the
+// room to stop.
+func (self *Room) Close(disconnected messages.Disconnected) {
+	self.enqueue(func() {
+		self.closing = &disconnected
+	})
+}
+
+// Sends the reason to every connected player after the messages already
+// queued, and closes the connections once it was written or the write
+// timeout is over.
+func (self *Room) drainConnections(disconnected messages.Disconnected) {
+	type pendingFarewell struct {
+		connection rpc.Transport
+		written    chan struct{}
+	}
+
+	pending := []pendingFarewell{}
+	self.players.Each(func(playerId types.PlayerId, playerConn *playerConnection) {
+		playerConn.mutex.Lock()
+		connection, isConnected := playerConn.conn, playerConn.isConnected
+		playerConn.mutex.Unlock()
+
+		if !isConnected {
+			return
+		}
+		written := make(chan struct{})
+		self.queueMessage(playerId, playerConn, outboxEntry{
+			message: rpc.NewBaseMessage(disconnected),
+			written: written,
+		})
+		pending = append(pending, pendingFarewell{connection, written})
+	})
+	self.flushMessages()
+
+	deadline := time.After(writeTimeout)
+	for _, farewell := range pending {
+		select {
+		case <-farewell.written:
+		case <-deadline:
+		}
+		farewell.connection.Close()
+	}
+}
+
+// Disconnects every connected player with the reason.
+func (self *Room) closeConnections(disconnected messages.Disconnected) {
+	self.players.Each(func(playerId types.PlayerId, playerConn *playerConnection) {
+		playerConn.mutex.Lock()
+		connection, isConnected, logger := playerConn.conn, playerConn.isConnected, playerConn.logger
+		playerConn.mutex.Unlock()
+
+		if isConnected {
+			go self.kickPlayer(logger, connection, disconnected)
+		}
+	})
+}
+
+// Queues the message for the player without waiting for it to be written.
+func (self *Room) sendMessage(playerId types.PlayerId, playerConn *playerConnection, message rpc.BaseMessage) {
+	self.queueMessage(playerId, playerConn, outboxEntry{message: message})
+}
+
+// Like sendMessage, but the snapshot replaces the ones still waiting to be sent.
+func (self *Room) sendSnapshot(playerId types.PlayerId, playerConn *playerConnection, message rpc.BaseMessage) {
+	self.queueMessage(playerId, playerConn, outboxEntry{message: message, isSnapshot: true})
+}
+
+func (self *Room) queueMessage(playerId types.PlayerId, playerConn *playerConnection, entry outboxEntry) {
+	playerConn.mutex.Lock()
+	connection, outbox, isConnected, logger := playerConn.conn, playerConn.outbox, playerConn.isConnected, playerConn.logger
+	playerConn.mutex.Unlock()
+
+	if !isConnected {
+		self.metrics.DropSend(dropDisconnected)
+		return
+	}
+
+	// A client that can not keep up would only get further behind, so it is
+	// dropped and left to reconnect.
+	if err := outbox.Push(entry); err != nil {
+		self.metrics.DropSend(dropQueueFull)
+		logger.Warn("Dropping the player", "error", err)
+		connection.Close()
+	}
+}
+
+// Sends the messages queued for every player since the last flush.
+func (self *Room) flushMessages() {
+	self.players.Each(func(_ types.PlayerId, playerConn *playerConnection) {
+		playerConn.flush()
+	})
+}
+
+func (self *Room) broadcastMessage(message rpc.BaseMessage) {
+	self.players.Each(func(playerId types.PlayerId, playerConn *playerConnection) {
+		self.sendMessage(playerId, playerConn, message)
+	})
+}
+
+// For each playerid that does not match the sender, send the message.
+func (self *Room) broadcastMessageExcept(except types.PlayerId, message rpc.BaseMessage) {
+	self.players.Each(func(playerId types.PlayerId, playerConn *playerConnection) {
+		if except == playerId {
+			return
+		}
+		self.sendMessage(playerId, playerConn, message)
+	})
+}
+
+func (self *Room) ConnectedPlayers() int {
+	return self.players.Connected()
+}
+
+// Removes the ships of the players that did not come back in time, freeing
+// their ids for new players.
+func (self *Room) evictStalePlayers() {
+	for _, playerId := range self.players.Stale(self.config.ReconnectGracePeriod) {
+		if player := self.simulation.FindCorrespondingPlayer(playerId); player != nil {
+			self.simulation.RemovePlayer(player)
+		}
+		self.players.Release(playerId)
+	}
+}
+
+func (self *Room) establishConnection(ctx context.Context, connection rpc.Transport, connectionHandshake messages.ConnectionHandshake, session *sessionClaims) (types.PlayerId, error) {
+	var admitted admission
+	var err error
+	if !self.execute(func() {
+		admitted, err = self.admitPlayer(connection, connectionHandshake, session)
+	}) {
+		err = fmt.Errorf("The room %s is closed", self.code)
+		rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(messages.HandshakeRejected{
+			Reason:  messages.RejectRoomNotFound,
+			Message: err.Error(),
+		}))
+		return types.InvalidPlayerId, err
+	}
+
+	if err != nil {
+		rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(messages.HandshakeRejected{
+			Reason:  messages.RejectRoomFull,
+			Message: fmt.Sprintf("The room %s is full", self.code),
+		}))
+		return types.InvalidPlayerId, err
+	}
+
+	codec := rpc.NegotiateCodec(self.config.Codec, connectionHandshake.Codecs)
+	if connectionHandshake.ProtocolVersion <= messages.LegacyProtocolVersion {
+		codec = rpc.LegacyCodec
+	}
+	connection.SetCodec(codec)
+	admitted.response.Codec = codec.Name()
+
+	if err := rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(admitted.response)); err != nil {
+		self.enqueue(func() {
+			self.disconnectPlayer(admitted.playerId, connection)
+		})
+		return types.InvalidPlayerId, err
+	}
+
+	// Tell the other players that this player has joined.
+	self.broadcastMessageExcept(admitted.playerId, admitted.announcement)
+
+	return admitted.playerId, nil
+}
+
+// Gives the player its ship back when the session is still valid or a new one
+// otherwise. Runs on the goroutine of the room.
+func (self *Room) admitPlayer(connection rpc.Transport, connectionHandshake messages.ConnectionHandshake, session *sessionClaims) (admission, error) {
+	if session != nil && session.RoomCode == self.code {
+		if playerId, ok := self.resumeSession(connection, connectionHandshake, *session); ok {
+			return admission{
+				playerId: playerId,
+				response: self.handshakeResponse(playerId),
+				announcement: rpc.NewBaseMessage(messages.EventPlayerReconnected{
+					PlayerId: playerId,
+				}),
+			}, nil
+		}
+	}
+
+	playerConn := &playerConnection{
+		conn:            connection,
+		isConnected:     true,
+		protocolVersion: connectionHandshake.ProtocolVersion,
+		capabilities:    messages.NegotiateCapabilities(connectionHandshake.ProtocolVersion, connectionHandshake.Capabilities),
+		outbox:          newOutbox(self.config.SendQueueSize, self.metrics),
+		cheats:          anticheat.NewTracker(&self.config.AntiCheat),
+	}
+	playerId, err := self.players.Register(playerConn)
+	if err != nil {
+		return admission{}, err
+	}
+	playerConn.logger = self.playerLogger(playerId, connectionHandshake.PlayerName, connection)
+
+	position := self.simulation.GenerateRandomPlayerPosition()
+	self.simulation.CreatePlayer(playerId, &position, connectionHandshake.PlayerName, true)
+
+	return admission{
+		playerId: playerId,
+		response: self.handshakeResponse(playerId),
+		announcement: rpc.NewBaseMessage(messages.EventPlayerConnected{
+			PlayerId:   playerId,
+			PlayerName: connectionHandshake.PlayerName,
+			Position:   position,
+		}),
+	}, nil
+}
+
+// Hands the ship back to a player that reconnected within the grace period.
+func (self *Room) resumeSession(connection rpc.Transport, connectionHandshake messages.ConnectionHandshake, session sessionClaims) (types.PlayerId, bool) {
+	playerId := session.PlayerId
+	playerConn := self.players.Get(playerId)
+	if playerConn == nil {
+		return types.InvalidPlayerId, false
+	}
+
+	playerConn.mutex.Lock()
+	defer playerConn.mutex.Unlock()
+
+	// The id was handed to someone else after the player was evicted.
+	if playerConn.session != session.Session {
+		return types.InvalidPlayerId, false
+	}
+
+	if !playerConn.isConnected && time.Since(playerConn.disconnectedAt) > self.config.ReconnectGracePeriod {
+		return types.InvalidPlayerId, false
+	}
+
+	// The old connection might be half-open and not noticed as dropped yet.
+	if playerConn.isConnected {
+		playerConn.conn.Close()
+	}
+
+	playerConn.conn = connection
+	playerConn.isConnected = true
+	// The player might come back with another build of the game.
+	playerConn.protocolVersion = connectionHandshake.ProtocolVersion
+	playerConn.capabilities = messages.NegotiateCapabilities(connectionHandshake.ProtocolVersion, connectionHandshake.Capabilities)
+	playerConn.outbox = newOutbox(self.config.SendQueueSize, self.metrics)
+
+	player := self.simulation.FindCorrespondingPlayer(playerId)
+	playerConn.logger = self.playerLogger(playerId, component.Player.Get(player).Name, connection)
+	self.simulation.RegisterPlayerReconnection(player)
+	return playerId, true
+}
+
+// Marks the player as gone, unless it reconnected through another connection
+// which now owns the ship. Runs on the goroutine of the room.
+func (self *Room) disconnectPlayer(playerId types.PlayerId, connection rpc.Transport) {
+	playerConn := self.players.Get(playerId)
+	if playerConn == nil {
+		return
+	}
+
+	playerConn.mutex.Lock()
+	if playerConn.conn != connection || !playerConn.isConnected {
+		playerConn.mutex.Unlock()
+		return
+	}
+	playerConn.isConnected = false
+	playerConn.disconnectedAt = time.Now()
+	playerConn.mutex.Unlock()
+
+	player := self.simulation.FindCorrespondingPlayer(playerId)
+	self.simulation.RegisterPlayerDisconnection(player)
+	if self.ConnectedPlayers() == 0 {
+		self.emptySince = time.Now()
+	}
+	self.broadcastMessageExcept(playerId, rpc.NewBaseMessage(messages.EventPlayerDisconnected{
+		PlayerId: playerId,
+	}))
+}
+
+func (self *Room) playerLogger(playerId types.PlayerId, name string, connection rpc.Transport) *slog.Logger {
+	return self.logger.With("player", playerId, "name", name, "address", connection.RemoteAddr())
+}
+
+func (self *Room) handshakeResponse(playerId types.PlayerId) messages.ConnectionHandshakeResponse {
+	playerConn := self.players.Get(playerId)
+	return messages.ConnectionHandshakeResponse{
+		ProtocolVersion: playerConn.protocolVersion,
+		Capabilities:    playerConn.capabilities,
+		PlayerId:        playerId,
+		PlayerData:      self.getPlayerData(),
+		RoomCode:        self.code,
+		SessionToken:    self.sessions.Sign(self.code, playerId, playerConn.session),
+	}
+}
+
+func (self *Room) getPlayerData() []messages.PlayerData {
+	enemyData := []messages.PlayerData{}
+	query := donburi.NewQuery(filter.Contains(component.Player, component.Position))
+
+	for player := range query.Iter(self.simulation.ECS.World) {
+		data := component.Player.Get(player)
+
+		enemyData = append(enemyData,
+			messages.PlayerData{
+				PlayerId:    data.Id,
+				PlayerName:  data.Name,
+				IsConnected: data.IsConnected,
+				Position:    *component.Position.Get(player),
+			},
+		)
+	}
+	return enemyData
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"testing"
+
+	"astro-blasters/game"
+	"astro-blasters/game/component"
+	"astro-blasters/game/types"
+	"astro-blasters/rpc"
+	"astro-blasters/server/messages"
+)
+
+func TestBulletOfEvictedShooter(t *testing.T) {
+	room := NewRoom("ABCDE", newTestConfig(), newSessionSigner("secret"), nil, newServerMetrics())
+	shooter, _ := admitTestPlayer(t, room)
+	victim, _ := admitTestPlayer(t, room)
+
+	shooterEntry := room.simulation.FindCorrespondingPlayer(shooter.PlayerId)
+	bullet := room.simulation.FireBullet(shooterEntry, *component.Position.Get(shooterEntry))
+	room.simulation.RemovePlayer(shooterEntry)
+
+	victimEntry := room.simulation.FindCorrespondingPlayer(victim.PlayerId)
+	room.simulation.UpdatePlayerHealth(victim.PlayerId, game.PlayerDamagePerHit)
+	room.onBulletCollide(victimEntry, bullet)
+
+	if component.Player.Get(victimEntry).IsAlive {
+		t.Error("The victim survived a bullet of a shooter that left")
+	}
+}
+
+// Type of the last snapshot queued for the player, after clearing the queue.
+func takeSnapshotType(playerConn *playerConnection) rpc.MessageType {
+	playerConn.outbox.mutex.Lock()
+	defer playerConn.outbox.mutex.Unlock()
+
+	var messageType rpc.MessageType
+	for _, entry := range playerConn.outbox.entries {
+		if entry.isSnapshot {
+			messageType = entry.message.MessageType
+		}
+	}
+	playerConn.outbox.entries = nil
+	return messageType
+}
+
+func TestCorrectedMoveGetsFullSnapshot(t *testing.T) {
+	room := NewRoom("ABCDE", newTestConfig(), newSessionSigner("secret"), nil, newServerMetrics())
+	claims, playerConn := admitTestPlayer(t, room)
+
+	snapshotAfterAck := func() rpc.MessageType {
+		room.simulation.Update()
+		room.broadcastSnapshot()
+		takeSnapshotType(playerConn)
+		playerConn.lastAcknowledgedTick.Store(room.simulation.Tick)
+
+		room.simulation.Update()
+		room.broadcastSnapshot()
+		return takeSnapshotType(playerConn)
+	}
+	if messageType := snapshotAfterAck(); messageType != rpc.TypeOf[messages.WorldSnapshotDelta]() {
+		t.Fatalf("Got a %s, expected a delta against the acknowledged snapshot", rpc.NameOf(messageType))
+	}
+
+	position := *component.Position.Get(room.simulation.FindCorrespondingPlayer(claims.PlayerId))
+	position.X += 1000
+	if !room.checkMove(claims.PlayerId, playerConn, playerConn.conn, messages.RegisterPlayerMove{
+		Move:     types.PlayerStartForward,
+		Sequence: 1,
+		Position: position,
+	}) {
+		t.Fatal("The move was dropped, expected it to be corrected")
+	}
+
+	// A snapshot sent before the correction is acknowledged in the meantime.
+	playerConn.lastAcknowledgedTick.Store(room.simulation.Tick)
+	room.simulation.Update()
+	room.broadcastSnapshot()
+	if messageType := takeSnapshotType(playerConn); messageType != rpc.TypeOf[messages.WorldSnapshot]() {
+		t.Errorf("Got a %s after a corrected move, expected a full snapshot", rpc.NameOf(messageType))
+	}
+	if messageType := snapshotAfterAck(); messageType != rpc.TypeOf[messages.WorldSnapshotDelta]() {
+		t.Errorf("Got a %s after the correction, expected deltas again", rpc.NameOf(messageType))
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"astro-blasters/server/config"
+	"astro-blasters/server/messages"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	roomCodeLength = 5
+	// Letters and digits that are hard to confuse with each other.
+	roomCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+	// How long a room is kept around without any connected player.
+	roomIdleTimeout = 30 * time.Second
+)
+
+var ErrTooManyRooms = errors.New("Too many rooms are open")
+
+// Returned once the server started shutting down.
+var ErrShuttingDown = errors.New("The server is shutting down")
+
+// Hosts the rooms of the server, each one running its own simulation.
+type RoomManager struct {
+	mutex    sync.Mutex
+	config   *config.ServerConfig
+	rooms    map[string]*Room
+	sessions *sessionSigner
+	bans     *banList
+	metrics  *serverMetrics
+	// Set once the server is shutting down, no room is created afterwards.
+	closed bool
+}
+
+func NewRoomManager(config *config.ServerConfig, bans *banList, metrics *serverMetrics) *RoomManager {
+	return &RoomManager{
+		config:   config,
+		rooms:    make(map[string]*Room),
+		sessions: newSessionSigner(config.SessionSecret),
+		bans:     bans,
+		metrics:  metrics,
+	}
+}
+
+// Creates a room with a new code and starts its simulation. Fails once the
+// maximum number of rooms is open.
+func (self *RoomManager) Create() (*Room, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return nil, ErrShuttingDown
+	}
+	if len(self.rooms) >= self.config.MaxRooms {
+		return nil, fmt.Errorf("%w, try again later or join one of them", ErrTooManyRooms)
+	}
+
+	code := generateRoomCode()
+	for self.rooms[code] != nil {
+		code = generateRoomCode()
+	}
+
+	room := NewRoom(code, self.config, self.sessions, self.bans, self.metrics)
+	self.rooms[code] = room
+
+	go func() {
+		room.updateState(self.removeIfIdle)
+		// Also after a crash of the room, which does not go through removeIfIdle.
+		self.remove(room)
+	}()
+	return room, nil
+}
+
+// Stops creating rooms and returns the open ones, which are then the last
+// rooms of the server.
+func (self *RoomManager) Close() []*Room {
+	self.mutex.Lock()
+	self.closed = true
+	self.mutex.Unlock()
+
+	return self.All()
+}
+
+func (self *RoomManager) Get(code string) *Room {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.rooms[strings.ToUpper(code)]
+}
+
+// Returns every open room, sorted by code.
+func (self *RoomManager) All() []*Room {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	rooms := make([]*Room, 0, len(self.rooms))
+	for _, room := range self.rooms {
+		rooms = append(rooms, room)
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].code < rooms[j].code
+	})
+
+	return rooms
+}
+
+func (self *RoomManager) List() []messages.RoomInfo {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	rooms := []messages.RoomInfo{}
+	for code, room := range self.rooms {
+		rooms = append(rooms, messages.RoomInfo{
+			RoomCode:    code,
+			PlayerCount: room.ConnectedPlayers(),
+		})
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].RoomCode < rooms[j].RoomCode
+	})
+
+	return rooms
+}
+
+// Returns the room that issued the session token, if it is still open.
+func (self *RoomManager) ResumeSession(token string) (*Room, *sessionClaims) {
+	claims, err := self.sessions.Verify(token)
+	if err != nil {
+		return nil, nil
+	}
+
+	room := self.Get(claims.RoomCode)
+	if room == nil {
+		return nil, nil
+	}
+	return room, &claims
+}
+
+// Removes the room once nobody has been connected to it for a while. Rooms
+// are kept at least as long as their players may still reconnect.
+func (self *RoomManager) removeIfIdle(room *Room) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	idleTimeout := max(roomIdleTimeout, self.config.ReconnectGracePeriod)
+	if room.ConnectedPlayers() > 0 || time.Since(room.emptySince) < idleTimeout {
+		return false
+	}
+
+	delete(self.rooms, room.code)
+	return true
+}
+
+func (self *RoomManager) remove(room *Room) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.rooms[room.code] == room {
+		delete(self.rooms, room.code)
+	}
+}
+
+func generateRoomCode() string {
+	var code strings.Builder
+	for i := 0; i < roomCodeLength; i++ {
+		code.WriteByte(roomCodeAlphabet[rand.Intn(len(roomCodeAlphabet))])
+	}
+	return code.String()
+}
@@ -2,286 +2,274 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math"
+	"log/slog"
 	"net"
-	"sync"
+	"sync/atomic"
 	"time"
 
-	"astro-blasters/game"
-	"astro-blasters/game/component"
-	"astro-blasters/game/types"
 	"astro-blasters/rpc"
+	"astro-blasters/server/config"
 	"astro-blasters/server/messages"
-	"log"
 	"net/http"
-
-	"github.com/coder/websocket"
-	"github.com/yohamta/donburi"
-	"github.com/yohamta/donburi/filter"
 )
 
 type Server struct {
-	serveMux   http.ServeMux
-	simulation *game.GameSimulation
-
-	players map[types.PlayerId]*playerConnection
+	config   *config.ServerConfig
+	serveMux http.ServeMux
+	rooms    *RoomManager
+	bans     *banList
+	metrics  *serverMetrics
+	// Shared by every lobby connection, since each of them makes one request.
+	lobbyLimiter *addressLimiter
+
+	// Set once the server started shutting down, new players are turned away.
+	shuttingDown atomic.Bool
 }
 
-type playerConnection struct {
-	mutex          sync.Mutex
-	conn           *websocket.Conn
-	isConnected    bool
-	lastBulletFire time.Time
-}
+func NewServer(config *config.ServerConfig) (*Server, error) {
+	bans, err := newBanList(config.BansFile)
+	if err != nil {
+		return nil, err
+	}
 
-func NewServer() *Server {
-	s := &Server{}
-	s.players = make(map[types.PlayerId]*playerConnection)
+	s := &Server{
+		config:       config,
+		bans:         bans,
+		metrics:      newServerMetrics(),
+		lobbyLimiter: newAddressLimiter(config.LobbyRateLimit),
+	}
+	s.rooms = NewRoomManager(config, bans, s.metrics)
+	rpc.SetMaxMessageSize(config.MaxMessageSize)
+	rpc.SetObserver(s.metrics)
 
 	s.serveMux.HandleFunc("/play/ws", s.ws)
+	s.serveMux.HandleFunc("GET /metrics", s.serveMetrics)
+	if config.AdminToken != "" {
+		s.serveMux.Handle("/admin/", http.StripPrefix("/admin", s.adminHandler()))
+	}
 	s.serveMux.Handle("/", http.FileServer(http.Dir("server/static/")))
-
-	s.simulation = game.NewGameSimulation()
-
-	s.simulation.OnBulletCollide = s.onBulletCollide
-	s.simulation.OnBulletFire = s.onBulletFire
-	return s
+	return s, nil
 }
 
-func (self *Server) onBulletFire(player *donburi.Entry) {
-	playerId := component.Player.Get(player).Id
-	connection := self.players[playerId]
-	now := time.Now()
+// Serves until the context is done, at which point no new connection is
+// accepted. The connections already open are left to Shutdown.
+func (self *Server) Start(ctx context.Context, port int) error {
+	httpServer := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: &self.serveMux}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
 
-	if connection.lastBulletFire.IsZero() || now.Sub(connection.lastBulletFire) >= 300*time.Millisecond {
-		connection.lastBulletFire = now
-		self.broadcastMessage(rpc.NewBaseMessage(messages.EventPlayerFireBullet{
-			PlayerId: playerId,
-		}))
-		self.simulation.RegisterPlayerFire(player)
+	slog.Info("Server started", "address", fmt.Sprintf("%s:%d", getLocalIP(), port))
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+	return nil
 }
 
-func (self *Server) onBulletCollide(player *donburi.Entry, bullet *donburi.Entry) {
-	playerData := component.Player.Get(player)
-	playerData.Health -= game.PlayerDamagePerHit
-
-	if playerData.Health > 0 {
-		self.broadcastMessage(rpc.NewBaseMessage(messages.EventUpdateHealth{
-			PlayerId: playerData.Id,
-			Health:   playerData.Health,
-		}))
-	} else if playerData.Health == 0 {
-		bulletData := component.Bullet.Get(bullet)
-		scorer := self.simulation.FindCorrespondingPlayer(bulletData.FiredBy)
+// Accepts players over raw TCP connections besides the websockets, for
+// clients that do not run in a browser. Stops accepting them once the
+// context is done.
+func (self *Server) StartTCP(ctx context.Context, port int) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	slog.Info("Accepting TCP connections", "address", fmt.Sprintf("%s:%d", getLocalIP(), port))
 
-		scorerData := component.Player.Get(scorer)
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go self.HandleConnection(rpc.NewStreamTransport(connection))
+	}
+}
 
-		self.broadcastMessage(rpc.NewBaseMessage(messages.EventPlayerDied{
-			PlayerId: playerData.Id,
-			KilledBy: scorerData.Id,
+// Warns the connected players, waits for the countdown and closes every room
+// once their players got the messages queued for them. New players are turned
+// away meanwhile. The bans are saved last, even when the context is done
+// before the rooms are closed.
+func (self *Server) Shutdown(ctx context.Context, reason string) error {
+	self.shuttingDown.Store(true)
+	countdown := self.config.ShutdownCountdown
+	slog.Info("Shutting down", "reason", reason, "countdown", countdown)
+
+	// Taken once no room can be created anymore, so that none is left out.
+	rooms := self.rooms.Close()
+	for _, room := range rooms {
+		room.broadcastMessage(rpc.NewBaseMessage(messages.ServerShuttingDown{
+			Reason:    reason,
+			Countdown: countdown,
 		}))
-
-		self.simulation.RegisterPlayerDeath(player, scorer)
-
-		go func() {
-			time.Sleep(5 * time.Second)
-			position := game.GenerateRandomPlayerPosition()
-			self.simulation.RespawnPlayer(player, position)
-
-			self.broadcastMessage(rpc.NewBaseMessage(messages.EventPlayerRespawned{
-				PlayerId: playerData.Id,
-				Position: position,
-			}))
-		}()
 	}
-}
 
-func (self *Server) Start(port int) error {
-	fmt.Printf("Server started at %s:%d\n", getLocalIP(), port)
+	err := self.closeRooms(ctx, rooms, countdown, messages.Disconnected{
+		Reason:  messages.DisconnectServerShutdown,
+		Message: reason,
+	})
+	return errors.Join(err, self.bans.Save())
+}
 
-	go self.updateState()
+func (self *Server) closeRooms(ctx context.Context, rooms []*Room, countdown time.Duration, disconnected messages.Disconnected) error {
+	select {
+	case <-time.After(countdown):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), &self.serveMux)
+	for _, room := range rooms {
+		room.Close(disconnected)
+	}
+	for _, room := range rooms {
+		select {
+		case <-room.stopped:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
 func (self *Server) ws(w http.ResponseWriter, r *http.Request) {
-	connection, err := websocket.Accept(w, r, nil)
+	connection, err := rpc.AcceptWebsocket(w, r)
 	if err != nil {
 		fmt.Fprintf(w, "Connection Failed")
 		return
 	}
 
-	self.handleConnection(connection)
+	self.HandleConnection(connection)
 }
 
-func (self *Server) handleConnection(connection *websocket.Conn) error {
+// The first message decides what the connection is for, the lobby lists and
+// creates rooms while the players join one. Any transport can be handed in,
+// such as one end of rpc.NewPipe to play in the same process.
+func (self *Server) HandleConnection(connection rpc.Transport) (err error) {
 	ctx := context.Background()
-	// Register the connected player.
-	playerId, err := self.establishConnection(ctx, connection)
-	if err != nil {
-		return err
-	}
-
+	defer connection.Close()
 	defer func() {
-		connection.CloseNow()
-		player := self.simulation.FindCorrespondingPlayer(playerId)
-		self.simulation.RegisterPlayerDisconnection(player)
-		self.players[playerId].isConnected = false
-		self.broadcastMessageExcept(playerId, rpc.NewBaseMessage(messages.EventPlayerDisconnected{
-			PlayerId: playerId,
-		}))
+		if recovered := recover(); recovered != nil {
+			logPanic(slog.Default().With("address", connection.RemoteAddr()), recovered)
+			err = fmt.Errorf("Panic while handling the connection: %v", recovered)
+		}
 	}()
 
-	for {
-		var message rpc.BaseMessage
-		err := rpc.ReceiveMessage(ctx, connection, &message)
-		status := websocket.CloseStatus(err)
+	var message rpc.BaseMessage
+	if err := rpc.ReceiveMessage(ctx, connection, &message); err != nil {
+		return err
+	}
+	// Clients of protocol 1 can only read its envelope.
+	if message.Codec() == rpc.LegacyCodec {
+		connection.SetCodec(rpc.LegacyCodec)
+	}
 
-		if status == websocket.StatusGoingAway || status == websocket.StatusAbnormalClosure {
-			break
+	router := rpc.NewRouter()
+	rpc.Handle(router, func(listRooms messages.ListRooms) error {
+		if rejection, rejected := self.checkLobbyRequest(connection, listRooms.ProtocolVersion); rejected {
+			return rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(rejection))
 		}
-
-		if err != nil {
-			break
+		return rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(messages.ListRoomsResponse{
+			Rooms: self.rooms.List(),
+		}))
+	})
+	rpc.Handle(router, func(createRoom messages.CreateRoom) error {
+		if rejection, rejected := self.checkLobbyRequest(connection, createRoom.ProtocolVersion); rejected {
+			return rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(rejection))
 		}
 
-		switch message.MessageType {
-		case "RegisterPlayerMove":
-			var registerPlayerMove messages.RegisterPlayerMove
-			if err := rpc.DecodeExpectedMessage(message, &registerPlayerMove); err != nil {
-				continue
-			}
-			player := self.simulation.FindCorrespondingPlayer(playerId)
-			expectedPosition := component.Position.Get(player)
-
-			if !isPositionWithinTolerance(*expectedPosition, registerPlayerMove.Position, 3.0) {
-				self.broadcastMessage(rpc.NewBaseMessage(messages.UpdatePosition{
-					Position: *expectedPosition,
-					PlayerId: playerId,
-				}))
+		room, err := self.rooms.Create()
+		if err != nil {
+			reason := messages.RejectTooManyRooms
+			if errors.Is(err, ErrShuttingDown) {
+				reason = messages.RejectShuttingDown
 			}
-
-			self.simulation.RegisterPlayerMove(playerId, registerPlayerMove.Move)
-			self.broadcastMessage(rpc.NewBaseMessage(messages.EventPlayerMove{
-				Move:     registerPlayerMove.Move,
-				PlayerId: playerId,
+			return rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(messages.HandshakeRejected{
+				Reason:  reason,
+				Message: err.Error(),
 			}))
 		}
-	}
-	return nil
-}
+		return rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(messages.CreateRoomResponse{
+			RoomCode: room.code,
+		}))
+	})
+	rpc.Handle(router, func(connectionHandshake messages.ConnectionHandshake) error {
+		return self.joinRoom(ctx, connection, connectionHandshake)
+	})
 
-func isPositionWithinTolerance(expected component.PositionData, got component.PositionData, tolerance float64) bool {
-	return math.Pow(expected.X-got.X, 2)+math.Pow(expected.Y-got.Y, 2)+math.Pow(expected.Angle-got.Angle, 2) <= math.Pow(tolerance, 2)
+	return router.Dispatch(message)
 }
 
-func (self *Server) updateState() {
-	ticker := time.NewTicker(time.Millisecond * 16) // ~60 FPS
-	defer ticker.Stop()
-
-	for range ticker.C {
-		self.simulation.Update()
+// Turns away the lobby requests of addresses making too many of them, banned
+// addresses and outdated clients, and every request once the server is
+// shutting down.
+func (self *Server) checkLobbyRequest(connection rpc.Transport, protocolVersion int) (messages.HandshakeRejected, bool) {
+	if !self.lobbyLimiter.Allow(connection.RemoteAddr()) {
+		return messages.HandshakeRejected{
+			Reason:  messages.RejectRateLimited,
+			Message: "Too many requests, try again in a few seconds",
+		}, true
 	}
-}
-
-func (self *Server) sendMessage(playerId types.PlayerId, playerConn *playerConnection, message rpc.BaseMessage) {
-	// Lock the mutex to ensure only one goroutine writes at a time
-	playerConn.mutex.Lock()
-	defer playerConn.mutex.Unlock()
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-
-	if !playerConn.isConnected {
-		return
+	if ban, banned := self.bans.Find(connection.RemoteAddr(), ""); banned {
+		return newBanRejection(ban), true
 	}
-
-	// Write the message to the connection
-	err := rpc.WriteMessage(ctx, playerConn.conn, message)
-	if err != nil {
-		log.Printf("Failed to send message to player %d: %v", playerId, err)
+	if !messages.IsCompatibleVersion(protocolVersion) {
+		return messages.NewVersionRejection(protocolVersion), true
 	}
-}
-
-func (self *Server) broadcastMessage(message rpc.BaseMessage) {
-	for playerId, playerConn := range self.players {
-		go self.sendMessage(playerId, playerConn, message)
+	if self.shuttingDown.Load() {
+		return shuttingDownRejection, true
 	}
+	return messages.HandshakeRejected{}, false
 }
 
-// For each playerid that does not match the sender, send the message.
-func (self *Server) broadcastMessageExcept(except types.PlayerId, message rpc.BaseMessage) {
-	for playerId, playerConn := range self.players {
-		if except == playerId {
-			continue
-		}
-		go self.sendMessage(playerId, playerConn, message)
-	}
+var shuttingDownRejection = messages.HandshakeRejected{
+	Reason:  messages.RejectShuttingDown,
+	Message: ErrShuttingDown.Error(),
 }
 
-func (self *Server) getAvailablePlayerId() types.PlayerId {
-	return types.PlayerId(len(self.players))
+func newBanRejection(ban Ban) messages.HandshakeRejected {
+	return messages.HandshakeRejected{
+		Reason:  messages.RejectBanned,
+		Message: fmt.Sprintf("You are banned for %s: %s", time.Until(ban.Until).Round(time.Second), ban.Reason),
+	}
 }
 
-func (self *Server) establishConnection(ctx context.Context, connection *websocket.Conn) (types.PlayerId, error) {
-	var connectionHandshake messages.ConnectionHandshake
-	if err := rpc.ReceiveExpectedMessage(ctx, connection, &connectionHandshake); err != nil {
-		return types.InvalidPlayerId, nil
+func (self *Server) joinRoom(ctx context.Context, connection rpc.Transport, connectionHandshake messages.ConnectionHandshake) error {
+	if self.shuttingDown.Load() {
+		return rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(shuttingDownRejection))
 	}
 
-	playerId := self.getAvailablePlayerId()
-	position := game.GenerateRandomPlayerPosition()
-
-	self.players[playerId] = &playerConnection{
-		conn:        connection,
-		isConnected: true,
+	if ban, banned := self.bans.Find(connection.RemoteAddr(), connectionHandshake.PlayerName); banned {
+		slog.Info("Rejected a banned player", "name", connectionHandshake.PlayerName, "address", connection.RemoteAddr())
+		return rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(newBanRejection(ban)))
 	}
 
-	self.simulation.CreatePlayer(playerId, &position, connectionHandshake.PlayerName, true)
-
-	playerData := self.getPlayerData()
-	err := rpc.WriteMessage(
-		ctx,
-		connection,
-		rpc.NewBaseMessage(messages.ConnectionHandshakeResponse{
-			PlayerId:   playerId,
-			PlayerData: playerData,
-		}),
-	)
-
-	if err != nil {
-		log.Fatal(err)
+	if !messages.IsCompatibleVersion(connectionHandshake.ProtocolVersion) {
+		return rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(
+			messages.NewVersionRejection(connectionHandshake.ProtocolVersion),
+		))
 	}
 
-	// Tell the other players that this player has joined.
-	self.broadcastMessageExcept(playerId, rpc.NewBaseMessage(messages.EventPlayerConnected{
-		PlayerId:   playerId,
-		PlayerName: connectionHandshake.PlayerName,
-		Position:   position,
-	}))
-
-	return playerId, nil
-}
-
-func (self *Server) getPlayerData() []messages.PlayerData {
-	enemyData := []messages.PlayerData{}
-	query := donburi.NewQuery(filter.Contains(component.Player, component.Position))
-
-	for player := range query.Iter(self.simulation.ECS.World) {
-		data := component.Player.Get(player)
-
-		enemyData = append(enemyData,
-			messages.PlayerData{
-				PlayerId:    data.Id,
-				PlayerName:  data.Name,
-				IsConnected: data.IsConnected,
-				Position:    *component.Position.Get(player),
-			},
-		)
+	room, session := self.rooms.ResumeSession(connectionHandshake.SessionToken)
+	if room == nil {
+		room = self.rooms.Get(connectionHandshake.RoomCode)
+	}
+	if room == nil {
+		return rpc.WriteMessage(ctx, connection, rpc.NewBaseMessage(messages.HandshakeRejected{
+			Reason:  messages.RejectRoomNotFound,
+			Message: fmt.Sprintf("There is no room with the code %s", connectionHandshake.RoomCode),
+		}))
 	}
-	return enemyData
+
+	return room.handleConnection(ctx, connection, connectionHandshake, session)
 }
 
 // From: https://stackoverflow.com/a/31551220
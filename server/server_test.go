@@ -0,0 +1,285 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"astro-blasters/game/types"
+	"astro-blasters/rpc"
+	"astro-blasters/server/messages"
+)
+
+// Joins the room, or takes the ship back when a session token is given, and
+// returns the connection along with the token of the session.
+func joinTestRoom(t *testing.T, server *Server, roomCode string, token string) (rpc.Transport, string) {
+	client, token, _ := joinTestRoomAndListen(t, server, roomCode, token)
+	return client, token
+}
+
+// Like joinTestRoom, also returning the Disconnected message of the server
+// if it sends one.
+func joinTestRoomAndListen(t *testing.T, server *Server, roomCode string, token string) (rpc.Transport, string, <-chan messages.Disconnected) {
+	disconnected := make(chan messages.Disconnected, 1)
+	client, connection := rpc.NewPipe()
+	go server.HandleConnection(connection)
+
+	ctx := context.Background()
+	err := rpc.WriteMessage(ctx, client, rpc.NewBaseMessage(messages.ConnectionHandshake{
+		ProtocolVersion: messages.ProtocolVersion,
+		Capabilities:    messages.SupportedCapabilities,
+		PlayerName:      "player",
+		RoomCode:        roomCode,
+		SessionToken:    token,
+	}))
+	if err != nil {
+		t.Error(err)
+		return client, token, disconnected
+	}
+
+	var message rpc.BaseMessage
+	if err := rpc.ReceiveMessage(ctx, client, &message); err != nil {
+		t.Error(err)
+		return client, token, disconnected
+	}
+	var response messages.ConnectionHandshakeResponse
+	if err := rpc.DecodeExpectedMessage(message, &response); err != nil {
+		t.Error(err)
+		return client, token, disconnected
+	}
+
+	// Keeps the outbox of the server from filling up.
+	go func() {
+		for {
+			if rpc.ReceiveMessage(ctx, client, &message) != nil {
+				return
+			}
+			var received messages.Disconnected
+			if rpc.DecodeExpectedMessage(message, &received) == nil {
+				disconnected <- received
+			}
+		}
+	}()
+	return client, response.SessionToken, disconnected
+}
+
+func TestConcurrentPlayers(t *testing.T) {
+	const players = 4
+	const reconnections = 5
+
+	server, err := NewServer(newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := server.rooms.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moves := []types.PlayerMove{
+		types.PlayerStartForward,
+		types.PlayerStartFireBullet,
+		types.PlayerStartRotateClockwise,
+		types.PlayerStopFireBullet,
+		types.PlayerStopRotateClockwise,
+		types.PlayerStopForward,
+	}
+
+	var wait sync.WaitGroup
+	for range players {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			ctx := context.Background()
+
+			var client rpc.Transport
+			token := ""
+			for reconnection := range reconnections {
+				previous := client
+				client, token = joinTestRoom(t, server, room.code, token)
+				// Every other time the old connection is left half-open for the
+				// new one to take over.
+				if previous != nil && reconnection%2 == 0 {
+					previous.Close()
+				}
+
+				for sequence, move := range moves {
+					rpc.WriteMessage(ctx, client, rpc.NewBaseMessage(messages.RegisterPlayerMove{
+						Move:     move,
+						Sequence: uint32(reconnection*len(moves) + sequence + 1),
+					}))
+					rpc.WriteMessage(ctx, client, rpc.NewBaseMessage(messages.AcknowledgeSnapshot{}))
+					time.Sleep(5 * time.Millisecond)
+				}
+			}
+		}()
+	}
+	wait.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for room.ConnectedPlayers() != players && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if connected := room.ConnectedPlayers(); connected != players {
+		t.Errorf("Got %d connected players, expected %d", connected, players)
+	}
+	if !room.execute(func() {}) {
+		t.Error("The room stopped")
+	}
+}
+
+func expectDisconnected(t *testing.T, disconnected <-chan messages.Disconnected, reason messages.DisconnectReason) {
+	select {
+	case received := <-disconnected:
+		if received.Reason != reason {
+			t.Errorf("Disconnected with the reason %d, expected %d", received.Reason, reason)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Not disconnected, expected the reason %d", reason)
+	}
+}
+
+func TestMalformedMessagesAreSkipped(t *testing.T) {
+	config := newTestConfig()
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := server.rooms.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _, disconnected := joinTestRoomAndListen(t, server, room.code, "")
+	defer client.Close()
+	ctx := context.Background()
+
+	for range config.MaxRateViolations {
+		if err := client.WriteFrame(ctx, []byte{0xc1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rpc.WriteMessage(ctx, client, rpc.NewBaseMessage(messages.AcknowledgeSnapshot{})); err != nil {
+		t.Fatalf("The connection was closed after skipping malformed messages: %v", err)
+	}
+	select {
+	case received := <-disconnected:
+		t.Fatalf("Disconnected with %q after skipping malformed messages", received.Message)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	client.WriteFrame(ctx, []byte{0xc1})
+	expectDisconnected(t, disconnected, messages.DisconnectRateLimited)
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	config := newTestConfig()
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := server.rooms.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _, disconnected := joinTestRoomAndListen(t, server, room.code, "")
+	defer client.Close()
+
+	go client.WriteFrame(context.Background(), make([]byte, config.MaxMessageSize+1))
+	expectDisconnected(t, disconnected, messages.DisconnectMessageTooLarge)
+}
+
+func TestUnexpectedMessagesAreViolations(t *testing.T) {
+	config := newTestConfig()
+	// Only the violations can get the client dropped.
+	config.DefaultRateLimit.Burst = 1000
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := server.rooms.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _, disconnected := joinTestRoomAndListen(t, server, room.code, "")
+	defer client.Close()
+
+	// A lobby request has no business in a room.
+	for range config.MaxRateViolations + 1 {
+		rpc.WriteMessage(context.Background(), client, rpc.NewBaseMessage(messages.ListRooms{}))
+	}
+	expectDisconnected(t, disconnected, messages.DisconnectRateLimited)
+}
+
+// A client of the oldest version still accepted, only reading the envelope of
+// protocol 1 and one message per frame.
+func TestLegacyClientCanPlay(t *testing.T) {
+	server, err := NewServer(newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := server.rooms.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, connection := rpc.NewPipe()
+	defer client.Close()
+	go server.HandleConnection(connection)
+	client.SetCodec(rpc.LegacyCodec)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = rpc.WriteMessage(ctx, client, rpc.NewBaseMessage(messages.ConnectionHandshake{
+		ProtocolVersion: messages.LegacyProtocolVersion,
+		Capabilities:    messages.CapabilityDeltaSnapshots,
+		PlayerName:      "veteran",
+		RoomCode:        room.code,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func() rpc.BaseMessage {
+		var message rpc.BaseMessage
+		if err := rpc.ReceiveMessage(ctx, client, &message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Codec() != rpc.LegacyCodec {
+			t.Fatalf("Got a message in %s, expected %s", message.Codec().Name(), rpc.LegacyCodec.Name())
+		}
+		if message.MessageType == rpc.TypeOf[rpc.Batch]() {
+			t.Fatal("Got a batch, which protocol 1 does not have")
+		}
+		return message
+	}
+
+	var response messages.ConnectionHandshakeResponse
+	if err := rpc.DecodeExpectedMessage(receive(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.ProtocolVersion != messages.LegacyProtocolVersion {
+		t.Errorf("Agreed on the protocol %d, expected %d", response.ProtocolVersion, messages.LegacyProtocolVersion)
+	}
+
+	err = rpc.WriteMessage(ctx, client, rpc.NewBaseMessage(messages.RegisterPlayerMove{
+		Move:     types.PlayerStartForward,
+		Sequence: 1,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movedSeen, snapshotSeen := false, false
+	for !movedSeen || !snapshotSeen {
+		message := receive()
+		var moved messages.EventPlayerMove
+		if rpc.DecodeExpectedMessage(message, &moved) == nil && moved.PlayerId == response.PlayerId {
+			movedSeen = true
+		}
+		var snapshot messages.WorldSnapshot
+		if rpc.DecodeExpectedMessage(message, &snapshot) == nil {
+			snapshotSeen = true
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"astro-blasters/game/types"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSessionToken = errors.New("Invalid session token")
+
+// What a session token vouches for.
+type sessionClaims struct {
+	RoomCode string
+	PlayerId types.PlayerId
+	Session  uint64
+	IssuedAt int64
+}
+
+// Issues and verifies the tokens that let players take over their ship again
+// after their connection dropped.
+type sessionSigner struct {
+	secret []byte
+}
+
+// A random secret is used when none is given, so the tokens do not outlive
+// the process.
+func newSessionSigner(secret string) *sessionSigner {
+	if secret != "" {
+		return &sessionSigner{secret: []byte(secret)}
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	return &sessionSigner{secret: random}
+}
+
+func (self *sessionSigner) Sign(roomCode string, playerId types.PlayerId, session uint64) string {
+	payload, _ := json.Marshal(sessionClaims{
+		RoomCode: roomCode,
+		PlayerId: playerId,
+		Session:  session,
+		IssuedAt: time.Now().Unix(),
+	})
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(self.signature(encoded))
+}
+
+func (self *sessionSigner) Verify(token string) (sessionClaims, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return sessionClaims{}, ErrInvalidSessionToken
+	}
+
+	decodedSignature, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(decodedSignature, self.signature(encoded)) {
+		return sessionClaims{}, ErrInvalidSessionToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return sessionClaims{}, ErrInvalidSessionToken
+	}
+
+	var claims sessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return sessionClaims{}, ErrInvalidSessionToken
+	}
+	return claims, nil
+}
+
+func (self *sessionSigner) signature(encoded string) []byte {
+	mac := hmac.New(sha256.New, self.secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"astro-blasters/rpc"
+	"astro-blasters/server/messages"
+)
+
+func TestSessionTokenRoundTrip(t *testing.T) {
+	signer := newSessionSigner("secret")
+
+	claims, err := signer.Verify(signer.Sign("ABCDE", 3, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.RoomCode != "ABCDE" || claims.PlayerId != 3 || claims.Session != 7 {
+		t.Errorf("Got %+v, expected the signed claims", claims)
+	}
+}
+
+func TestTamperedSessionToken(t *testing.T) {
+	signer := newSessionSigner("secret")
+	token := signer.Sign("ABCDE", 3, 7)
+	encoded, signature, _ := strings.Cut(token, ".")
+
+	// Someone else's ship, with the original signature.
+	forged, _ := json.Marshal(sessionClaims{RoomCode: "ABCDE", PlayerId: 4, Session: 7})
+	forgedPayload := base64.RawURLEncoding.EncodeToString(forged) + "." + signature
+
+	flipped := []byte(signature)
+	flipped[0] ^= 1
+
+	tests := map[string]string{
+		"forged payload":   forgedPayload,
+		"flipped bit":      encoded + "." + string(flipped),
+		"no signature":     encoded,
+		"empty signature":  encoded + ".",
+		"other secret":     newSessionSigner("other").Sign("ABCDE", 3, 7),
+		"random secret":    newSessionSigner("").Sign("ABCDE", 3, 7),
+		"not base64":       "!!!." + signature,
+		"empty":            "",
+		"trailing garbage": token + "x",
+	}
+
+	for name, token := range tests {
+		if _, err := signer.Verify(token); !errors.Is(err, ErrInvalidSessionToken) {
+			t.Errorf("%s: got %v, expected %v", name, err, ErrInvalidSessionToken)
+		}
+	}
+}
+
+// Lets a player into a room that is not running, which is enough to check
+// whether its session can be resumed.
+func admitTestPlayer(t *testing.T, room *Room) (sessionClaims, *playerConnection) {
+	_, connection := rpc.NewPipe()
+	admitted, err := room.admitPlayer(connection, messages.ConnectionHandshake{ProtocolVersion: messages.ProtocolVersion, PlayerName: "player", Capabilities: messages.SupportedCapabilities}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := room.sessions.Verify(admitted.response.SessionToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims, room.players.Get(admitted.playerId)
+}
+
+func disconnectTestPlayer(playerConn *playerConnection, since time.Duration) {
+	playerConn.mutex.Lock()
+	defer playerConn.mutex.Unlock()
+
+	playerConn.isConnected = false
+	playerConn.disconnectedAt = time.Now().Add(-since)
+}
+
+func TestResumeSession(t *testing.T) {
+	config := newTestConfig()
+	room := NewRoom("ABCDE", config, newSessionSigner("secret"), nil, newServerMetrics())
+	claims, playerConn := admitTestPlayer(t, room)
+	disconnectTestPlayer(playerConn, config.ReconnectGracePeriod/2)
+
+	_, connection := rpc.NewPipe()
+	if playerId, ok := room.resumeSession(connection, messages.ConnectionHandshake{}, claims); !ok || playerId != claims.PlayerId {
+		t.Errorf("Got the player %d and %v, expected to resume %d", playerId, ok, claims.PlayerId)
+	}
+}
+
+func TestResumeExpiredSession(t *testing.T) {
+	config := newTestConfig()
+	room := NewRoom("ABCDE", config, newSessionSigner("secret"), nil, newServerMetrics())
+	claims, playerConn := admitTestPlayer(t, room)
+	disconnectTestPlayer(playerConn, 2*config.ReconnectGracePeriod)
+
+	_, connection := rpc.NewPipe()
+	if _, ok := room.resumeSession(connection, messages.ConnectionHandshake{}, claims); ok {
+		t.Error("Resumed a session past the reconnect grace period")
+	}
+}
+
+func TestResumeSessionOfPreviousPlayer(t *testing.T) {
+	config := newTestConfig()
+	room := NewRoom("ABCDE", config, newSessionSigner("secret"), nil, newServerMetrics())
+	claims, _ := admitTestPlayer(t, room)
+
+	// The player is evicted and its id handed to the next one.
+	room.players.Release(claims.PlayerId)
+	next, _ := admitTestPlayer(t, room)
+	if next.PlayerId != claims.PlayerId {
+		t.Fatalf("The id %d was not reused, got %d", claims.PlayerId, next.PlayerId)
+	}
+
+	_, connection := rpc.NewPipe()
+	if _, ok := room.resumeSession(connection, messages.ConnectionHandshake{}, claims); ok {
+		t.Error("Resumed the session of the previous owner of the id")
+	}
+}
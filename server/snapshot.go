@@ -0,0 +1,99 @@
+package server
+
+import (
+	"astro-blasters/game/component"
+	"astro-blasters/game/types"
+	"astro-blasters/rpc"
+	"astro-blasters/server/messages"
+
+	"github.com/yohamta/donburi"
+	"github.com/yohamta/donburi/filter"
+)
+
+// Number of past snapshots kept around to compute deltas against.
+const maxSnapshotHistory = 32
+
+// Captures the authoritative state of the simulation.
+func (self *Room) getWorldSnapshot() messages.WorldSnapshot {
+	world := self.simulation.ECS.World
+	snapshot := messages.WorldSnapshot{
+		Tick:       self.simulation.Tick,
+		Players:    []messages.PlayerSnapshot{},
+		Bullets:    []messages.BulletSnapshot{},
+		Explosions: []messages.ExplosionSnapshot{},
+	}
+
+	for player := range donburi.NewQuery(filter.Contains(component.Player, component.Position)).Iter(world) {
+		snapshot.Players = append(snapshot.Players, messages.PlayerSnapshot{
+			Player:   component.Player.GetValue(player),
+			Position: component.Position.GetValue(player),
+		})
+	}
+
+	for bullet := range donburi.NewQuery(filter.Contains(component.Bullet, component.Position)).Iter(world) {
+		snapshot.Bullets = append(snapshot.Bullets, messages.BulletSnapshot{
+			Id:       uint64(bullet.Entity()),
+			FiredBy:  component.Bullet.Get(bullet).FiredBy,
+			Position: component.Position.GetValue(bullet),
+		})
+	}
+
+	for explosion := range donburi.NewQuery(filter.Contains(component.Explosion, component.Position)).Iter(world) {
+		snapshot.Explosions = append(snapshot.Explosions, messages.ExplosionSnapshot{
+			Id:       uint64(explosion.Entity()),
+			Count:    component.Explosion.Get(explosion).Count,
+			Position: component.Position.GetValue(explosion),
+		})
+	}
+
+	return snapshot
+}
+
+// Sends every player the current snapshot, delta encoded against the last one
+// that the player acknowledged when it is still in the history and the client
+// supports it.
+func (self *Room) broadcastSnapshot() {
+	snapshot := self.getWorldSnapshot()
+
+	self.snapshots = append(self.snapshots, snapshot)
+	if len(self.snapshots) > maxSnapshotHistory {
+		self.snapshots = self.snapshots[1:]
+	}
+
+	deltas := make(map[uint64]messages.WorldSnapshotDelta)
+
+	self.players.Each(func(playerId types.PlayerId, playerConn *playerConnection) {
+		lastProcessedSequence := playerConn.lastProcessedSequence.Load()
+		lastProcessedTick := playerConn.lastProcessedTick.Load()
+		ackedTick := playerConn.lastAcknowledgedTick.Load()
+		needsFullSnapshot := playerConn.needsFullSnapshot.Swap(false)
+
+		base, found := self.findSnapshot(ackedTick)
+		if !found || needsFullSnapshot || !playerConn.capabilities.Has(messages.CapabilityDeltaSnapshots) {
+			full := snapshot
+			full.LastProcessedSequence = lastProcessedSequence
+			full.LastProcessedTick = lastProcessedTick
+			self.sendSnapshot(playerId, playerConn, rpc.NewBaseMessage(full))
+			return
+		}
+
+		delta, ok := deltas[ackedTick]
+		if !ok {
+			delta = messages.DiffSnapshot(base, snapshot)
+			deltas[ackedTick] = delta
+		}
+		delta.LastProcessedSequence = lastProcessedSequence
+		delta.LastProcessedTick = lastProcessedTick
+
+		self.sendSnapshot(playerId, playerConn, rpc.NewBaseMessage(delta))
+	})
+}
+
+func (self *Room) findSnapshot(tick uint64) (messages.WorldSnapshot, bool) {
+	for _, snapshot := range self.snapshots {
+		if snapshot.Tick == tick {
+			return snapshot, true
+		}
+	}
+	return messages.WorldSnapshot{}, false
+}